@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 )
 
@@ -18,36 +17,55 @@ func cli_main(listPeersFlag bool, helpFlag bool, exitFlag bool) {
 	if helpFlag {
 		fmt.Println("Several commands can be used, the help command is used by default if none is provided.")
 		fmt.Println("Commands :")
-		fmt.Println("connect [name]: connects to a peer given its name. Our client will automatically fetch the public key and the root hash of this peer from the REST server.")
+		fmt.Println("clearCache : removes every datum kept on disk from previous downloads.")
+		fmt.Println("connect [name]: connects to a peer given its name, and makes it the current peer. Our client will automatically fetch the public key and the root hash of this peer from the REST server. Other connections are kept.")
 		fmt.Println("debugon : enables error display (disabled by default)")
 		fmt.Println("debugoff : disables error display (disabled by default)")
-		fmt.Println("disconnect : closes the connection to the current peer.")
+		fmt.Println("disconnect [name] : closes the connection to the given peer, or to the current peer if none is given.")
 		fmt.Println("download : downloads all data from the peer we are currently connected to. Requires a connection to a peer.")
-		fmt.Println("forceerron : simulates an error in every critical section (disabled by default)")
-		fmt.Println("forceerroff : stops simulating an error in every critical section (disabled by default)")
 		fmt.Println("exit : quits the program")
-		fmt.Println("exportKey : exports our private key to a external file in the project root.")
+		fmt.Println("fault [type] [drop|duplicate|reorder|corrupt] [rate] : injects faults in the datagrams of this type (hello, getdatum, datum... or all) or in REST requests (http), at a rate between 0 and 1.")
+		fmt.Println("fault [type] delay [duration] : delays the datagrams of this type, e.g. 200ms.")
+		fmt.Println("fault nat-sim [on|off] : puts us behind a simulated NAT, dropping the datagrams of anybody we did not write to first, to try NAT traversal on a single machine.")
+		fmt.Println("fault off [seed] : removes every injected fault, and restarts their generator from seed (1 by default). Without arguments, fault lists the current faults.")
+		fmt.Println("exportKey : exports our key pair to the key directory, the private key encrypted with a passphrase (asked, or read from P2P_PASSPHRASE).")
 		fmt.Println("generateKey : generates a new key, displays it. DOES NOT AUTOMATICALLY TURN ON SIGNATURE MODE.")
 		fmt.Println("help : displays this help and exits. Default behavior.")
-		fmt.Println("importKey : imports the private key from an external file, takes it as out private key, computes the associated public key, and assigns it as out public key.")
+		fmt.Println("history [peer] : lists the root hashes seen for a peer, the current one by default, with when and how they were received.")
+		fmt.Println("history [peer] diff [i] [j] : lists the files added, removed and modified between roots i and j of the history of a peer, j being the last one by default.")
+		fmt.Println("identity create [name] : creates a named identity with a new key, saves it to the keyring encrypted with a passphrase, and makes it the active identity.")
+		fmt.Println("identity use [name] : makes an identity of the keyring the active one : its name and key are used for every message, and it is loaded at startup.")
+		fmt.Println("identity delete [name] : removes an identity from the keyring. Without arguments, or with list, identity lists the keyring, the active identity marked with a *.")
+		fmt.Println("importKey : imports our private key from the key directory, decrypting it with its passphrase, and uses it to sign our messages. It is also loaded at startup.")
+		fmt.Println("known [list|accept|revoke] [name] : lists the keys pinned the first time we saw each peer, pins the key a peer now publishes after it changed, or forgets its pin.")
 		fmt.Println("list : fetches and displays a list of known peers from the server.")
+		fmt.Println("peers : lists the peers we are connected to, the current one marked with a *.")
 		fmt.Println("register : registers ourself to the REST server.")
 		fmt.Println("repon : details content for replies (disabled by default)")
 		fmt.Println("repoff : disables detailed content for replies (disabled by default)")
+		fmt.Println("requests : lists our requests still waiting for a reply, with their age and the times they were sent again, for debugging.")
 		fmt.Println("reqon : details content for requests (disabled by default)")
 		fmt.Println("reqoff : disables detailed content for requests (disabled by default)")
-		fmt.Println("setName [name] : changes your name as seen by the REST server.")
+		fmt.Println("setName [name] : changes the name of the active identity as seen by the REST server, for this session only.")
+		fmt.Println("setWindow [n] : sets the maximum amount of datum requests in flight during a download (32 by default).")
+		fmt.Println("share [path] : exports the given file or directory to other peers, and announces its root hash to the REST server.")
+		fmt.Println("signatures [off|opportunistic|strict] [name] : sets how the signatures of a peer, or of every peer without a name, are checked against their published keys. Without arguments, lists the policies.")
+		fmt.Println("swarm [roothash] : downloads the tree of the given root hash, or of the current peer, from every connected peer at once.")
+		fmt.Println("use [name] : makes the given connected peer the current peer, used by download.")
 		return
 	}
 	if listPeersFlag {
-		req := buildGetPeersRequest()
-		if req != nil || force_err {
-			resp, err := client.Do(req)
-			if err != nil || force_err {
-				log.Fatal("http.NewRequest: ", err)
-			}
-			processGetPeersResponse(resp)
+		req, err := buildGetPeersRequest()
+		if err != nil {
+			fmt.Println("Unable to list the peers : ", &RESTError{serv_url + "/peers", 0, fmt.Errorf("%w : invalid request : %w", ErrServer, err)})
+			return
 		}
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Println("Unable to list the peers : ", &RESTError{req.URL.String(), 0, networkError(err)})
+			return
+		}
+		processGetPeersResponse(resp)
 	}
 	if exitFlag {
 		// todo disconnect client
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"unicode/utf8"
+)
+
+/*
+	BINARY CODEC
+*/
+
+/*
+	Typed messages of the peer-to-peer protocol, with a Marshal method producing the datagram
+	and an Unmarshal method parsing one. Unmarshal never trusts the datagram : the header, the
+	Length field and the body size expected for the message type are all checked, and an error
+	is returned instead of slicing past the end of a short or truncated datagram.
+	A signature, if any, is the 64 bytes following the body.
+*/
+
+const (
+	MSG_NOOP                  byte = 0
+	MSG_ERROR                 byte = 1
+	MSG_HELLO                 byte = 2
+	MSG_PUBLIC_KEY            byte = 3
+	MSG_ROOT                  byte = 4
+	MSG_GET_DATUM             byte = 5
+	MSG_NAT_TRAVERSAL_REQUEST byte = 6
+	MSG_NAT_TRAVERSAL         byte = 7
+	MSG_ERROR_REPLY           byte = 128
+	MSG_HELLO_REPLY           byte = 129
+	MSG_PUBLIC_KEY_REPLY      byte = 130
+	MSG_ROOT_REPLY            byte = 131
+	MSG_DATUM                 byte = 132
+	MSG_NO_DATUM              byte = 133
+)
+
+const HEADER_SIZE = 7
+const SIGNATURE_SIZE = 64
+const HASH_SIZE = 32
+
+// all of them are protocol violations : errors.Is(err, ErrProtocol) holds
+var ErrShortPacket = fmt.Errorf("%w : datagram shorter than a header", ErrProtocol)
+var ErrTruncated = fmt.Errorf("%w : datagram shorter than its Length field", ErrProtocol)
+var ErrUnexpectedType = fmt.Errorf("%w : unexpected message type", ErrProtocol)
+var ErrBadLength = fmt.Errorf("%w : invalid body length for this message type", ErrProtocol)
+var ErrBadContent = fmt.Errorf("%w : invalid body content", ErrProtocol)
+
+/*
+	Generic frame : header, body and optional signature.
+*/
+
+type Frame struct {
+	Id        uint32
+	Type      byte
+	Body      []byte
+	Signature []byte // empty or 64 bytes
+}
+
+func (f *Frame) Marshal() ([]byte, error) {
+	if len(f.Body) > 0xFFFF {
+		return nil, fmt.Errorf("%w : body of %d bytes does not fit the Length field", ErrBadLength, len(f.Body))
+	}
+	if len(f.Signature) != 0 && len(f.Signature) != SIGNATURE_SIZE {
+		return nil, fmt.Errorf("%w : signature of %d bytes", ErrBadLength, len(f.Signature))
+	}
+	res := make([]byte, HEADER_SIZE, HEADER_SIZE+len(f.Body)+len(f.Signature))
+	binary.BigEndian.PutUint32(res[0:4], f.Id)
+	res[4] = f.Type
+	binary.BigEndian.PutUint16(res[5:7], uint16(len(f.Body)))
+	res = append(res, f.Body...)
+	res = append(res, f.Signature...)
+	return res, nil
+}
+
+func (f *Frame) Unmarshal(packet []byte) error {
+	if len(packet) < HEADER_SIZE {
+		return fmt.Errorf("%w : %d bytes", ErrShortPacket, len(packet))
+	}
+	length := int(binary.BigEndian.Uint16(packet[5:7]))
+	if len(packet) < HEADER_SIZE+length {
+		return fmt.Errorf("%w : %d bytes announced, %d received", ErrTruncated, length, len(packet)-HEADER_SIZE)
+	}
+	f.Id = binary.BigEndian.Uint32(packet[0:4])
+	f.Type = packet[4]
+	f.Body = packet[HEADER_SIZE : HEADER_SIZE+length]
+	f.Signature = nil
+	if len(packet) >= HEADER_SIZE+length+SIGNATURE_SIZE {
+		f.Signature = packet[HEADER_SIZE+length : HEADER_SIZE+length+SIGNATURE_SIZE]
+	}
+	return nil
+}
+
+/*
+	Part of the datagram covered by the signature : the header and the body.
+*/
+
+func (f *Frame) Signed() []byte {
+	res, _ := (&Frame{Id: f.Id, Type: f.Type, Body: f.Body}).Marshal()
+	return res
+}
+
+func unmarshalFrame(packet []byte, types ...byte) (*Frame, error) {
+	f := &Frame{}
+	if err := f.Unmarshal(packet); err != nil {
+		return nil, err
+	}
+	for _, t := range types {
+		if f.Type == t {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("%w : %d", ErrUnexpectedType, f.Type)
+}
+
+/*
+	Hello (2) and HelloReply (129)
+*/
+
+type HelloMsg struct {
+	Id         uint32
+	Type       byte // MSG_HELLO or MSG_HELLO_REPLY
+	Extensions uint32
+	Name       string
+	Signature  []byte
+}
+
+func (m *HelloMsg) Marshal() ([]byte, error) {
+	body := make([]byte, 4, 4+len(m.Name))
+	binary.BigEndian.PutUint32(body, m.Extensions)
+	body = append(body, []byte(m.Name)...)
+	return (&Frame{Id: m.Id, Type: m.Type, Body: body, Signature: m.Signature}).Marshal()
+}
+
+func (m *HelloMsg) Unmarshal(packet []byte) error {
+	f, err := unmarshalFrame(packet, MSG_HELLO, MSG_HELLO_REPLY)
+	if err != nil {
+		return err
+	}
+	if len(f.Body) < 4 {
+		return fmt.Errorf("%w : Hello body of %d bytes, expected at least 4", ErrBadLength, len(f.Body))
+	}
+	m.Id, m.Type, m.Signature = f.Id, f.Type, f.Signature
+	m.Extensions = binary.BigEndian.Uint32(f.Body[0:4])
+	m.Name = string(f.Body[4:])
+	return nil
+}
+
+/*
+	PublicKey (3) and PublicKeyReply (130) : an empty body, or a 64-byte key
+*/
+
+type PublicKeyMsg struct {
+	Id        uint32
+	Type      byte // MSG_PUBLIC_KEY or MSG_PUBLIC_KEY_REPLY
+	Key       []byte
+	Signature []byte
+}
+
+func (m *PublicKeyMsg) Marshal() ([]byte, error) {
+	if len(m.Key) != 0 && len(m.Key) != 64 {
+		return nil, fmt.Errorf("%w : public key of %d bytes", ErrBadLength, len(m.Key))
+	}
+	return (&Frame{Id: m.Id, Type: m.Type, Body: m.Key, Signature: m.Signature}).Marshal()
+}
+
+func (m *PublicKeyMsg) Unmarshal(packet []byte) error {
+	f, err := unmarshalFrame(packet, MSG_PUBLIC_KEY, MSG_PUBLIC_KEY_REPLY)
+	if err != nil {
+		return err
+	}
+	if len(f.Body) != 0 && len(f.Body) != 64 {
+		return fmt.Errorf("%w : public key of %d bytes, expected 0 or 64", ErrBadLength, len(f.Body))
+	}
+	m.Id, m.Type, m.Key, m.Signature = f.Id, f.Type, f.Body, f.Signature
+	return nil
+}
+
+/*
+	Root (4) and RootReply (131) : a 32-byte hash
+*/
+
+type RootMsg struct {
+	Id        uint32
+	Type      byte // MSG_ROOT or MSG_ROOT_REPLY
+	Hash      []byte
+	Signature []byte
+}
+
+func (m *RootMsg) Marshal() ([]byte, error) {
+	if len(m.Hash) != HASH_SIZE {
+		return nil, fmt.Errorf("%w : root hash of %d bytes", ErrBadLength, len(m.Hash))
+	}
+	return (&Frame{Id: m.Id, Type: m.Type, Body: m.Hash, Signature: m.Signature}).Marshal()
+}
+
+func (m *RootMsg) Unmarshal(packet []byte) error {
+	f, err := unmarshalFrame(packet, MSG_ROOT, MSG_ROOT_REPLY)
+	if err != nil {
+		return err
+	}
+	if len(f.Body) != HASH_SIZE {
+		return fmt.Errorf("%w : root hash of %d bytes, expected 32", ErrBadLength, len(f.Body))
+	}
+	m.Id, m.Type, m.Hash, m.Signature = f.Id, f.Type, f.Body, f.Signature
+	return nil
+}
+
+/*
+	GetDatum (5) and NoDatum (133) : a 32-byte hash
+*/
+
+type GetDatumMsg struct {
+	Id   uint32
+	Type byte // MSG_GET_DATUM or MSG_NO_DATUM
+	Hash []byte
+}
+
+func (m *GetDatumMsg) Marshal() ([]byte, error) {
+	if len(m.Hash) != HASH_SIZE {
+		return nil, fmt.Errorf("%w : hash of %d bytes", ErrBadLength, len(m.Hash))
+	}
+	return (&Frame{Id: m.Id, Type: m.Type, Body: m.Hash}).Marshal()
+}
+
+func (m *GetDatumMsg) Unmarshal(packet []byte) error {
+	f, err := unmarshalFrame(packet, MSG_GET_DATUM, MSG_NO_DATUM)
+	if err != nil {
+		return err
+	}
+	if len(f.Body) != HASH_SIZE {
+		return fmt.Errorf("%w : hash of %d bytes, expected 32", ErrBadLength, len(f.Body))
+	}
+	m.Id, m.Type, m.Hash = f.Id, f.Type, f.Body
+	return nil
+}
+
+/*
+	Datum (132) : a 32-byte hash followed by the value, whose first byte is the datatype
+*/
+
+type DatumMsg struct {
+	Id    uint32
+	Hash  []byte
+	Value []byte
+}
+
+func (m *DatumMsg) Marshal() ([]byte, error) {
+	if len(m.Hash) != HASH_SIZE {
+		return nil, fmt.Errorf("%w : hash of %d bytes", ErrBadLength, len(m.Hash))
+	}
+	body := make([]byte, 0, HASH_SIZE+len(m.Value))
+	body = append(body, m.Hash...)
+	body = append(body, m.Value...)
+	return (&Frame{Id: m.Id, Type: MSG_DATUM, Body: body}).Marshal()
+}
+
+func (m *DatumMsg) Unmarshal(packet []byte) error {
+	f, err := unmarshalFrame(packet, MSG_DATUM)
+	if err != nil {
+		return err
+	}
+	if len(f.Body) < HASH_SIZE+1 {
+		return fmt.Errorf("%w : Datum body of %d bytes, expected at least 33", ErrBadLength, len(f.Body))
+	}
+	m.Id = f.Id
+	m.Hash = f.Body[:HASH_SIZE]
+	m.Value = f.Body[HASH_SIZE:]
+	return nil
+}
+
+/*
+	NatTraversalRequest (6) and NatTraversal (7) : an IPv4 (6 bytes) or IPv6 (18 bytes) socket address
+*/
+
+type NatTraversalMsg struct {
+	Id        uint32
+	Type      byte // MSG_NAT_TRAVERSAL_REQUEST or MSG_NAT_TRAVERSAL
+	Addr      netip.AddrPort
+	Signature []byte
+}
+
+func (m *NatTraversalMsg) Marshal() ([]byte, error) {
+	if !m.Addr.IsValid() {
+		return nil, fmt.Errorf("%w : invalid socket address", ErrBadContent)
+	}
+	ip := m.Addr.Addr().Unmap()
+	body := ip.AsSlice() // 4 bytes for IPv4, 16 for IPv6
+	body = binary.BigEndian.AppendUint16(body, m.Addr.Port())
+	return (&Frame{Id: m.Id, Type: m.Type, Body: body, Signature: m.Signature}).Marshal()
+}
+
+func (m *NatTraversalMsg) Unmarshal(packet []byte) error {
+	f, err := unmarshalFrame(packet, MSG_NAT_TRAVERSAL_REQUEST, MSG_NAT_TRAVERSAL)
+	if err != nil {
+		return err
+	}
+	if len(f.Body) != 6 && len(f.Body) != 18 {
+		return fmt.Errorf("%w : socket address of %d bytes, expected 6 or 18", ErrBadLength, len(f.Body))
+	}
+	ip, _ := netip.AddrFromSlice(f.Body[:len(f.Body)-2])
+	port := binary.BigEndian.Uint16(f.Body[len(f.Body)-2:])
+	m.Id, m.Type, m.Signature = f.Id, f.Type, f.Signature
+	m.Addr = netip.AddrPortFrom(ip, port)
+	return nil
+}
+
+/*
+	Error (1) and ErrorReply (128) : a human-readable UTF-8 message
+*/
+
+type ErrorMsg struct {
+	Id      uint32
+	Type    byte // MSG_ERROR or MSG_ERROR_REPLY
+	Message string
+}
+
+func (m *ErrorMsg) Marshal() ([]byte, error) {
+	return (&Frame{Id: m.Id, Type: m.Type, Body: []byte(m.Message)}).Marshal()
+}
+
+func (m *ErrorMsg) Unmarshal(packet []byte) error {
+	f, err := unmarshalFrame(packet, MSG_ERROR, MSG_ERROR_REPLY)
+	if err != nil {
+		return err
+	}
+	m.Id, m.Type = f.Id, f.Type
+	m.Message = string(f.Body)
+	if !utf8.ValidString(m.Message) {
+		m.Message = fmt.Sprintf("%q", f.Body) // still display something readable
+	}
+	return nil
+}
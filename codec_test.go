@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+/*
+	The decoders are fed arbitrary datagrams : they must never panic, and whatever they accept
+	must encode back to the same message.
+*/
+
+func codecSeeds(f *testing.F) {
+	key := make([]byte, 64)
+	hash := make([]byte, HASH_SIZE)
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 1, MSG_HELLO, 0, 50, 1})          // Length past the end
+	f.Add([]byte{0, 0, 0, 1, MSG_GET_DATUM, 0, 3, 1, 2, 3}) // short hash
+	f.Add([]byte{0, 0, 0, 1, MSG_NAT_TRAVERSAL, 0, 5, 1, 2, 3, 4, 5})
+	f.Add(helloToByteSlice(buildHelloRequest("alice", 1, 0)))
+	f.Add(helloToByteSlice(buildHelloReply("bob", 2)))
+	f.Add(requestToByteSlice(buildPubkeyRequestWithPubkey(3, key)))
+	f.Add(requestToByteSlice(buildPubkeyReplyNoPubkey(4)))
+	f.Add(requestToByteSlice(buildRootRequest(5, hash)))
+	f.Add(requestToByteSlice(buildDatumRequest(hash, 6)))
+	f.Add(requestToByteSlice(buildNoDatumReply(hash, 7)))
+	f.Add(datumToByteSlice(buildDatumReply([]byte{0, 0, 0, 8}, []byte{0, 'h', 'i'}, hash)))
+	f.Add(natTraversalToByteSlice(buildNatTraversalRequest(netip.MustParseAddrPort("192.0.2.1:8443"), 9)))
+	f.Add(natTraversalToByteSlice(buildNatTraversalRequest(netip.MustParseAddrPort("[2001:db8::1]:8443"), 10)))
+	f.Add(requestToByteSlice(buildErrorReply("no", 11)))
+	f.Add(signByteSlice(helloToByteSlice(buildHelloRequest("carol", 12, 0)), privKeyGen()))
+}
+
+func FuzzFrame(f *testing.F) {
+	codecSeeds(f)
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		frame := &Frame{}
+		if frame.Unmarshal(packet) != nil {
+			return
+		}
+		res, err := frame.Marshal()
+		if err != nil {
+			t.Fatal("accepted frame does not encode : ", err)
+		}
+		if !bytes.Equal(res, packet[:len(res)]) {
+			t.Fatalf("frame encodes to %x, received %x", res, packet)
+		}
+	})
+}
+
+type message interface {
+	Marshal() ([]byte, error)
+	Unmarshal(packet []byte) error
+}
+
+func FuzzMessages(f *testing.F) {
+	codecSeeds(f)
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		for _, m := range []message{&HelloMsg{}, &PublicKeyMsg{}, &RootMsg{}, &GetDatumMsg{}, &DatumMsg{}, &NatTraversalMsg{}, &ErrorMsg{}} {
+			if m.Unmarshal(packet) != nil {
+				continue
+			}
+			if nat, ok := m.(*NatTraversalMsg); ok {
+				// an IPv4-mapped address is sent as an IPv4 one
+				nat.Addr = netip.AddrPortFrom(nat.Addr.Addr().Unmap(), nat.Addr.Port())
+			}
+			res, err := m.Marshal()
+			if err != nil {
+				t.Fatalf("accepted %T does not encode : %v", m, err)
+			}
+			again := reflect.New(reflect.TypeOf(m).Elem()).Interface().(message)
+			if err := again.Unmarshal(res); err != nil {
+				t.Fatalf("%T does not decode its own encoding %x : %v", m, res, err)
+			}
+			if !reflect.DeepEqual(m, again) {
+				t.Fatalf("%T decodes to %+v, then to %+v", m, m, again)
+			}
+		}
+	})
+}
+
+/*
+	deliver is the first code to see a datagram from the network, with and without a key for
+	its sender, and whether or not it said hello.
+*/
+
+func FuzzDeliver(f *testing.F) {
+	codecSeeds(f)
+	setIdentity(&Identity{Name: "fuzz", Key: privKeyGen()})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		open := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 9}
+		s := getSession(open.String())
+		sessionsMutex.Lock()
+		s.helloDone = len(packet)%2 == 0
+		sessionsMutex.Unlock()
+		deliver(open, packet)
+		deliver(open, packet)
+
+		keyed := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 10}
+		s = getSession(keyed.String())
+		sessionsMutex.Lock()
+		s.pubkey = packet[:len(packet)/2]
+		s.hasKey = true
+		s.helloDone = true
+		sessionsMutex.Unlock()
+		s.await(1, make(chan Reply, 1))
+		deliver(keyed, packet)
+		s.abandon(1)
+	})
+}
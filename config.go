@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	CONFIGURATION
+*/
+
+/*
+	Every setting has a default, which can be overridden by the config file, then by an
+	environment variable, then by a command-line flag :
+
+	flag               variable               config file key   default
+	-config            P2P_CONFIG             (none)            ./p2p.conf, if it exists
+	-server-url        P2P_SERVER_URL         server_url        https://jch.irif.fr:8443
+	-server-addr       P2P_SERVER_ADDR        server_addr       jch.irif.fr:8443
+	-ca-file           P2P_CA_FILE            ca_file           system certificates
+	-pin               P2P_PIN                pin               none
+	-insecure          P2P_INSECURE           insecure          false
+	-http-timeout      P2P_HTTP_TIMEOUT       http_timeout      50s
+	-reply-timeout     P2P_REPLY_TIMEOUT      reply_timeout     1s
+	-request-deadline  P2P_REQUEST_DEADLINE   request_deadline  10s
+	-listen            P2P_LISTEN             listen            :0
+	-signatures        P2P_SIGNATURES         signatures        opportunistic
+	-server-name       P2P_SERVER_NAME        server_name       host of server_addr
+	-server-key        P2P_SERVER_KEY         server_key        fetched from /peers/<server_name>/key
+	-key-dir           P2P_KEY_DIR            key_dir           <user config dir>/p2p
+	-key-changes       P2P_KEY_CHANGES        key_changes       refuse
+
+	The config file holds one "key = value" per line, lines starting with # are ignored.
+	The pin is the hex SHA-256 of the DER certificate of the REST server : when given, this
+	exact certificate is accepted instead of checking its chain, which suits self-signed servers.
+	The certificate is always checked, unless insecure is explicitly set.
+	A UDP request is sent again if no reply came within reply_timeout, then waiting twice as
+	long every time, until request_deadline (see requests.go).
+	The server_key is the hex public key of the server, which must sign every UDP reply of the
+	server : when not given, it is fetched from the REST server under server_name at registration.
+*/
+
+type Config struct {
+	ServerURL       string
+	ServerAddr      string
+	CAFile          string
+	Pin             string
+	Insecure        bool
+	HTTPTimeout     time.Duration
+	ReplyTimeout    time.Duration
+	RequestDeadline time.Duration
+	ListenAddr      string
+	Signatures      SignaturePolicy
+	ServerName      string
+	ServerKey       []byte
+	KeyDir          string
+	KeyChanges      string
+}
+
+var reply_timeout = time.Second // how long we wait for a reply from the server or a peer before asking again
+
+func defaultConfig() Config {
+	return Config{
+		ServerURL:       "https://jch.irif.fr:8443",
+		ServerAddr:      "jch.irif.fr:8443",
+		HTTPTimeout:     50 * time.Second,
+		ReplyTimeout:    time.Second,
+		RequestDeadline: 10 * time.Second,
+		ListenAddr:      ":0",
+		Signatures:      SIG_OPPORTUNISTIC,
+		KeyDir:          defaultKeyDir(),
+		KeyChanges:      "refuse",
+	}
+}
+
+func defaultKeyDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(dir, "p2p")
+}
+
+/*
+	Sets one setting from its config file key. Flags and environment variables use the same keys.
+*/
+
+func (c *Config) set(key string, value string) error {
+	var err error
+	switch key {
+	case "server_url":
+		c.ServerURL = value
+	case "server_addr":
+		c.ServerAddr = value
+	case "ca_file":
+		c.CAFile = value
+	case "pin":
+		c.Pin = strings.ToLower(strings.ReplaceAll(value, ":", ""))
+	case "insecure":
+		c.Insecure, err = strconv.ParseBool(value)
+	case "http_timeout":
+		c.HTTPTimeout, err = time.ParseDuration(value)
+	case "reply_timeout":
+		c.ReplyTimeout, err = time.ParseDuration(value)
+	case "request_deadline":
+		c.RequestDeadline, err = time.ParseDuration(value)
+	case "listen":
+		c.ListenAddr = value
+	case "signatures":
+		c.Signatures, err = parseSignaturePolicy(value)
+	case "key_dir":
+		c.KeyDir = value
+	case "key_changes":
+		if value != "refuse" && value != "warn" {
+			err = errors.New("expected refuse or warn")
+		}
+		c.KeyChanges = value
+	case "server_name":
+		c.ServerName = value
+	case "server_key":
+		c.ServerKey, err = hex.DecodeString(value)
+		if err == nil && len(c.ServerKey) != 64 {
+			err = fmt.Errorf("%d bytes instead of 64", len(c.ServerKey))
+		}
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s : %w", value, key, err)
+	}
+	return nil
+}
+
+var configKeys = []string{"server_url", "server_addr", "ca_file", "pin", "insecure", "http_timeout", "reply_timeout", "request_deadline", "listen", "signatures", "server_name", "server_key", "key_dir", "key_changes"}
+var boolKeys = map[string]bool{"insecure": true} // given as -insecure on the command line, without a value
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return fmt.Errorf("%s:%d : expected key = value", path, lineno)
+		}
+		if err := c.set(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%s:%d : %w", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *Config) loadEnv() error {
+	for _, key := range configKeys {
+		value, found := os.LookupEnv("P2P_" + strings.ToUpper(key))
+		if !found {
+			continue
+		}
+		if err := c.set(key, value); err != nil {
+			return fmt.Errorf("P2P_%s : %w", strings.ToUpper(key), err)
+		}
+	}
+	return nil
+}
+
+/*
+	Builds the configuration from the config file, the environment and the command-line arguments.
+*/
+
+func loadConfig(args []string) (Config, error) {
+	c := defaultConfig()
+	flags := flag.NewFlagSet("p2p", flag.ContinueOnError)
+	configFile := flags.String("config", "", "configuration file (default ./p2p.conf, if it exists)")
+	for _, key := range configKeys {
+		if boolKeys[key] {
+			flags.Bool(strings.ReplaceAll(key, "_", "-"), false, "overrides the "+key+" setting")
+			continue
+		}
+		flags.String(strings.ReplaceAll(key, "_", "-"), "", "overrides the "+key+" setting")
+	}
+	if err := flags.Parse(args); err != nil {
+		return c, err
+	}
+	path := *configFile
+	if path == "" {
+		path = os.Getenv("P2P_CONFIG")
+	}
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return c, err
+		}
+	} else if err := c.loadFile("./p2p.conf"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return c, err
+	}
+	if err := c.loadEnv(); err != nil {
+		return c, err
+	}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && err == nil {
+			err = c.set(strings.ReplaceAll(f.Name, "-", "_"), f.Value.String())
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+	if _, err := url.ParseRequestURI(c.ServerURL); err != nil {
+		return c, fmt.Errorf("invalid server_url : %w", err)
+	}
+	if _, _, err := net.SplitHostPort(c.ServerAddr); err != nil {
+		return c, fmt.Errorf("invalid server_addr : %w", err)
+	}
+	return c, nil
+}
+
+/*
+	Applies the configuration to the globals used by the rest of the client.
+*/
+
+func (c Config) apply() error {
+	serv_url = strings.TrimRight(c.ServerURL, "/")
+	serv_addr = c.ServerAddr
+	serv_addr_noport, _, _ = net.SplitHostPort(c.ServerAddr)
+	serv_name = serv_addr_noport
+	if c.ServerName != "" {
+		serv_name = c.ServerName
+	}
+	serv_key = c.ServerKey
+	key_dir = c.KeyDir
+	refuse_key_changes = c.KeyChanges == "refuse"
+	listen_addr = c.ListenAddr
+	reply_timeout = c.ReplyTimeout
+	request_deadline = c.RequestDeadline
+	signature_policy = c.Signatures
+	var err error
+	client, err = c.httpClient()
+	return err
+}
+
+func (c Config) httpClient() (*http.Client, error) {
+	tlsconf := &tls.Config{}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA bundle : %w", err)
+		}
+		tlsconf.RootCAs = x509.NewCertPool()
+		if !tlsconf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+		}
+	}
+	if c.Pin != "" {
+		pin, err := hex.DecodeString(c.Pin)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("the pin must be the hex SHA-256 of the server certificate")
+		}
+		tlsconf.InsecureSkipVerify = true // the chain is not checked, the certificate itself is
+		tlsconf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no certificate from the server")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !compareHash(sum[:], pin) {
+				return fmt.Errorf("the server certificate %s does not match the pinned one", hex.EncodeToString(sum[:]))
+			}
+			return nil
+		}
+	} else if c.Insecure {
+		fmt.Println("Warning : the certificate of the REST server is not checked.")
+		tlsconf.InsecureSkipVerify = true
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsconf
+	return &http.Client{
+		Transport: &faultTransport{transport},
+		Timeout:   c.HTTPTimeout,
+	}, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigFlags(t *testing.T) {
+	t.Chdir(t.TempDir()) // no p2p.conf
+	t.Setenv("P2P_INSECURE", "false")
+	c, err := loadConfig([]string{"-insecure", "-reply-timeout", "2s", "-server-addr", "localhost:8443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Insecure || c.ReplyTimeout != 2*time.Second || c.ServerAddr != "localhost:8443" {
+		t.Fatalf("flags not applied : %+v", c)
+	}
+	c, err = loadConfig([]string{"-insecure=false"})
+	if err != nil || c.Insecure {
+		t.Fatal("-insecure=false not applied : ", err)
+	}
+	if _, err := loadConfig([]string{"-reply-timeout", "soon"}); err == nil {
+		t.Fatal("invalid duration accepted")
+	}
+}
@@ -9,29 +9,38 @@ import (
 	Custom struct converter for proper UDP datagram communication
 */
 
+/*
+	The builders fill the structs of p2p.go, and these converters hand them to the codec (see
+	codec.go) : every datagram we send is encoded by a Marshal method, the same code that
+	parses what we receive. The Length fields of the structs are not trusted, the codec
+	computes them from the body. A message the codec refuses is a bug of ours : it is reported
+	and nothing is sent.
+*/
+
+func encode(m interface{ Marshal() ([]byte, error) }) []byte {
+	res, err := m.Marshal()
+	if err != nil {
+		fmt.Println("Error : unable to encode our message : ", err)
+		return nil
+	}
+	return res
+}
+
 func helloToByteSlice(exchange *HelloExchange) []byte {
-	k := binary.BigEndian.Uint16(exchange.Length) // TODO err handling
+	res := encode(&HelloMsg{
+		Id:         binary.BigEndian.Uint32(exchange.Id),
+		Type:       exchange.Type,
+		Extensions: binary.BigEndian.Uint32(exchange.Extensions),
+		Name:       string(exchange.Name),
+		Signature:  exchange.Signature,
+	})
+	if res == nil {
+		return nil
+	}
+	k := binary.BigEndian.Uint16(res[5:7])
 	if debugmode {
 		fmt.Printf("Found length of Hello byte slice = %d\n", k)
 	}
-	res := make([]byte, 11+len(exchange.Name)+len(exchange.Signature))
-	for i := 0; i < 4; i++ {
-		res[i] = exchange.Id[i]
-	}
-	res[4] = exchange.Type
-	for i := 0; i < 2; i++ {
-		res[5+i] = exchange.Length[i]
-	}
-	for i := 0; i < 4; i++ {
-		res[7+i] = exchange.Extensions[i]
-	}
-	l := len(exchange.Name)
-	for i := 0; i < l; i++ {
-		res[11+i] = exchange.Name[i]
-	}
-	for i := 0; i < len(exchange.Signature); i++ {
-		res[11+l+i] = exchange.Signature[i]
-	}
 	if reqdisplay {
 		fmt.Println("*** Hello envoye:")
 		fmt.Println("Id: ", res[0:4])
@@ -44,26 +53,16 @@ func helloToByteSlice(exchange *HelloExchange) []byte {
 }
 
 func datumToByteSlice(datum *Datum) []byte {
-	l := binary.BigEndian.Uint16(datum.Length) // TODO err handling
-	if debugmode {
-		fmt.Printf("Found length of Datum byte slice = %d\n", l)
-	}
-	res := make([]byte, 7+l+uint16(len(datum.Signature)))
-	for i := 0; i < 4; i++ {
-		res[i] = datum.Id[i]
-	}
-	res[4] = datum.Type
-	for i := 0; i < 2; i++ {
-		res[5+i] = datum.Length[i]
-	}
-	for i := 0; i < 32; i++ {
-		res[7+i] = datum.Hash[i]
+	res := encode(&DatumMsg{
+		Id:    binary.BigEndian.Uint32(datum.Id),
+		Hash:  datum.Hash,
+		Value: datum.Value,
+	})
+	if res == nil {
+		return nil
 	}
-	for i := 0; i < int(l)-32; i++ {
-		res[39+i] = datum.Value[i]
-	}
-	for i := 0; i < len(datum.Signature); i++ {
-		res[uint16(7)+l+uint16(i)] = datum.Signature[i]
+	if debugmode {
+		fmt.Printf("Found length of Datum byte slice = %d\n", binary.BigEndian.Uint16(res[5:7]))
 	}
 	if reqdisplay {
 		fmt.Println("*** Datum envoye:")
@@ -72,36 +71,31 @@ func datumToByteSlice(datum *Datum) []byte {
 		fmt.Println("length: ", res[5:7])
 		fmt.Println("body:", res[7:39])
 		fmt.Println("datatype : ", res[39])
-		fmt.Println("signature: ", res[40:])
+		fmt.Println("value: ", res[40:])
 	}
 	return res
 }
 
 func requestToByteSlice(req *P2PMsg) []byte {
-	l := binary.BigEndian.Uint16(req.Length) // TODO err handling
+	res := encode(&Frame{
+		Id:        binary.BigEndian.Uint32(req.Id),
+		Type:      req.Type,
+		Body:      req.Body,
+		Signature: req.Signature,
+	})
+	if res == nil {
+		return nil
+	}
+	l := binary.BigEndian.Uint16(res[5:7])
 	if debugmode {
 		fmt.Printf("Found length of byte slice = %d\n", l)
 	}
-	res := make([]byte, uint16(7)+l+uint16(len(req.Signature)))
-	for i := 0; i < 4; i++ {
-		res[i] = req.Id[i]
-	}
-	res[4] = req.Type
-	for i := 0; i < 2; i++ {
-		res[5+i] = req.Length[i]
-	}
-	for i := 0; uint16(i) < l; i++ {
-		res[7+i] = req.Body[i]
-	}
-	for i := 0; i < len(req.Signature); i++ {
-		res[uint16(7)+l+uint16(i)] = req.Signature[i]
-	}
 	if reqdisplay {
 		fmt.Println("*** Requete envoyee :")
 		fmt.Println("Id: ", res[0:4])
 		fmt.Println("type: ", res[4])
 		fmt.Println("length: ", res[5:7])
-		if res[4] == 1 || res[4] == 127 { // Errors
+		if res[4] == MSG_ERROR || res[4] == MSG_ERROR_REPLY {
 			fmt.Println("body", string(res[7:l+7]))
 		} else {
 			fmt.Println("body:", res[7:l+7])
@@ -110,3 +104,18 @@ func requestToByteSlice(req *P2PMsg) []byte {
 	}
 	return res
 }
+
+func natTraversalToByteSlice(req *NatTraversalMsg) []byte {
+	res := encode(req)
+	if res == nil {
+		return nil
+	}
+	if reqdisplay {
+		fmt.Println("*** NatTraversalRequest envoyee :")
+		fmt.Println("Id: ", res[0:4])
+		fmt.Println("type: ", res[4])
+		fmt.Println("length: ", res[5:7])
+		fmt.Println("address : ", req.Addr)
+	}
+	return res
+}
@@ -5,12 +5,9 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/hex"
-	"encoding/pem"
 	"log"
 	"math/big"
-	"os"
 )
 
 /*
@@ -19,7 +16,7 @@ import (
 
 func privKeyGen() *ecdsa.PrivateKey {
 	privkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil || force_err {
+	if err != nil {
 		log.Fatal("Error generating the private key")
 	}
 	return privkey
@@ -51,7 +48,7 @@ func byteSliceToPubkey(byteslice []byte) *ecdsa.PublicKey {
 func signByteSlice(data []byte, privkey *ecdsa.PrivateKey) []byte {
 	hashed := sha256.Sum256(data)
 	r, s, err := ecdsa.Sign(rand.Reader, privkey, hashed[:])
-	if err != nil || force_err {
+	if err != nil {
 		log.Fatal("Error signing the message")
 	}
 	signature := make([]byte, 64)
@@ -62,49 +59,12 @@ func signByteSlice(data []byte, privkey *ecdsa.PrivateKey) []byte {
 }
 
 func verify(data []byte, signature []byte, pubkey *ecdsa.PublicKey) bool {
+	if len(signature) != 64 || pubkey == nil || !pubkey.Curve.IsOnCurve(pubkey.X, pubkey.Y) {
+		return false // never trust a truncated signature or a key that is not a point of P-256
+	}
 	var r, s big.Int
 	r.SetBytes(signature[:32])
 	s.SetBytes(signature[32:])
 	hashed := sha256.Sum256(data)
 	return ecdsa.Verify(pubkey, hashed[:], &r, &s)
 }
-
-func encode(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey) (string, string) {
-	x509Encoded, _ := x509.MarshalECPrivateKey(privateKey)
-	pemEncoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509Encoded})
-
-	x509EncodedPub, _ := x509.MarshalPKIXPublicKey(publicKey)
-	pemEncodedPub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: x509EncodedPub})
-
-	return string(pemEncoded), string(pemEncodedPub)
-}
-
-func decode(pemEncoded string, pemEncodedPub string) (*ecdsa.PrivateKey, *ecdsa.PublicKey) {
-	block, _ := pem.Decode([]byte(pemEncoded))
-	x509Encoded := block.Bytes
-	privateKey, _ := x509.ParseECPrivateKey(x509Encoded)
-
-	blockPub, _ := pem.Decode([]byte(pemEncodedPub))
-	x509EncodedPub := blockPub.Bytes
-	genericPublicKey, _ := x509.ParsePKIXPublicKey(x509EncodedPub)
-	publicKey := genericPublicKey.(*ecdsa.PublicKey)
-
-	return privateKey, publicKey
-}
-
-var privkeyPEMpath = "./privkey.pem"
-var pubkeyPEMpath = "./pubkey.pem"
-
-func exportKey() {
-	privcode, pubcode := encode(privkey, byteSliceToPubkey(pubkey))
-	os.WriteFile(privkeyPEMpath, []byte(privcode), 0600)
-	os.WriteFile(pubkeyPEMpath, []byte(pubcode), 0600)
-}
-
-func importKey() {
-	privclear, _ := os.ReadFile(privkeyPEMpath)
-	pubclear, _ := os.ReadFile(pubkeyPEMpath)
-	var temp *ecdsa.PublicKey
-	privkey, temp = decode(string(privclear), string(pubclear))
-	pubkey = pubkeyToByteSlice(temp)
-}
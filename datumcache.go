@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/*
+	ON-DISK DATUM CACHE
+*/
+
+/*
+	A datum never changes without changing its hash, so every verified datum we receive is kept on
+	disk, in a file named after its hash : cacheDir/ab/abcdef... (the first byte of the hash is used as
+	a sub-directory, to avoid huge directories).
+	The download engine looks here before asking a peer, so that an interrupted download resumes where
+	it stopped, and a sub-tree already fetched from any peer is never fetched again.
+	The cache is bounded : when it grows over cacheMaxSize, the oldest datums are evicted.
+*/
+
+var cacheDir = "./datumcache"
+var cacheMaxSize int64 = 256 * 1024 * 1024
+
+var cacheSize int64 = -1 // unknown until the cache directory is first scanned
+var cacheMutex sync.Mutex
+
+func cachePath(hash []byte) string {
+	h := hex.EncodeToString(hash)
+	return filepath.Join(cacheDir, h[:2], h)
+}
+
+/*
+	Returns the Value field of the datum identified by hash, if we have it.
+	The value is checked again, as the file may have been altered on disk.
+*/
+
+func loadDatum(hash []byte) ([]byte, bool) {
+	if len(hash) != 32 {
+		return nil, false
+	}
+	value, err := os.ReadFile(cachePath(hash))
+	if err != nil {
+		return nil, false
+	}
+	if !verifyDatum(hash, value) {
+		logProgress("Corrupted datum in cache, removing it : " + hex.EncodeToString(hash))
+		os.Remove(cachePath(hash))
+		return nil, false
+	}
+	return value, true
+}
+
+/*
+	Stores a datum in the cache, unless its value does not match its hash.
+*/
+
+func storeDatum(hash []byte, value []byte) {
+	if len(hash) != 32 || !verifyDatum(hash, value) {
+		return
+	}
+	path := cachePath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return // already there
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		logProgress("Unable to create the cache directory : " + err.Error())
+		return
+	}
+	// write then rename, so that an interrupted write never leaves a partial datum
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, value, 0600)
+	if err != nil {
+		logProgress("Unable to write to the cache : " + err.Error())
+		return
+	}
+	os.Rename(tmp, path)
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if cacheSize < 0 {
+		cacheSize = scanCache(nil)
+	} else {
+		cacheSize = cacheSize + int64(len(value))
+	}
+	if cacheSize > cacheMaxSize {
+		evictCache()
+	}
+}
+
+type cacheEntry struct {
+	path string
+	info fs.FileInfo
+}
+
+/*
+	Returns the total size of the cache, and lists its entries if asked to.
+*/
+
+func scanCache(entries *[]cacheEntry) int64 {
+	var total int64 = 0
+	filepath.WalkDir(cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total = total + info.Size()
+		if entries != nil {
+			*entries = append(*entries, cacheEntry{path, info})
+		}
+		return nil
+	})
+	return total
+}
+
+/*
+	Removes the oldest datums until the cache is back under 90% of its maximum size.
+	Must be called with cacheMutex held.
+*/
+
+func evictCache() {
+	var entries []cacheEntry
+	cacheSize = scanCache(&entries)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].info.ModTime().Before(entries[j].info.ModTime())
+	})
+	for _, entry := range entries {
+		if cacheSize <= cacheMaxSize/10*9 {
+			break
+		}
+		if os.Remove(entry.path) == nil {
+			cacheSize = cacheSize - entry.info.Size()
+		}
+	}
+	logProgress("Cache evicted down to " + formatSize(cacheSize))
+}
+
+func clearCache() {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	os.RemoveAll(cacheDir)
+	cacheSize = 0
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	f := float64(size)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f = f / 1024
+		i++
+	}
+	return strconv.FormatFloat(f, 'f', 1, 64) + " " + units[i]
+}
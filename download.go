@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+	PIPELINED DOWNLOAD ENGINE
+*/
+
+/*
+	Instead of asking for one hash at a time and recursing depth-first, the engine keeps a queue
+	of hashes still to fetch and up to downloadWindow GetDatum requests in flight per peer, as it
+	may download from several peers sharing the same sub-trees at once. Each request has
+	its own id, so that replies can be matched whatever order they arrive in : the listener hands
+	the replies carrying the ids in flight to the engine, on a single channel. Hashes already present
+	in the datum cache are not asked for. Once every datum has been received, the Merkle tree is
+	rebuilt and verified from the root.
+
+	Congestion control follows the suggestion of the subject : the window of a peer grows by one for every
+	reply received and is halved (down to 1) every time a request has to be sent again.
+	Retransmission timeouts are computed from the measured round-trip times (Jacobson/Karels), and
+	backed off like any other request (see policy) : a hash nobody answered for within
+	request_deadline, or after MAX_DATUM_RETRIES attempts, stops the download. A peer answering
+	with an ErrorReply, or with a datum that does not match the hash we asked for, is not asked
+	for this hash again : the other peers are.
+*/
+
+var downloadWindow = 32 // maximum amount of GetDatum in flight, set with the setWindow command
+var MAX_DATUM_RETRIES = 8
+
+var MIN_RTO = 100 * time.Millisecond
+var MAX_RTO = 5 * time.Second
+
+type datumRequest struct {
+	hash    []byte
+	id      uint32
+	first   time.Time // first sending, to any peer
+	sent    time.Time
+	due     time.Time // when to send it again
+	retries int
+	source  *downloadSource
+}
+
+type requestKey struct {
+	session *Session
+	id      uint32
+}
+
+func (r *datumRequest) key() requestKey {
+	return requestKey{r.source.session, r.id}
+}
+
+/*
+	A peer we download from. Each one has its own congestion window and timeouts, and remembers
+	the hashes it answered NoDatum for, so that they are asked to another peer.
+*/
+
+type downloadSource struct {
+	conn     net.Conn
+	session  *Session
+	window   float64 // current congestion window, never above downloadWindow
+	inflight int
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	missing  map[string]bool // hashes this peer does not have
+	timeouts int             // timeouts since its last reply, the peer is given up after MAX_DATUM_RETRIES
+}
+
+type downloadEngine struct {
+	sources   []*downloadSource
+	queue     [][]byte
+	inflight  map[requestKey]*datumRequest // ids are only unique to the session of their source
+	requested map[string]bool              // hashes already queued, identical sub-trees are fetched once
+	values    map[string][]byte            // Value field of every datum received, by hash
+	fromCache int                          // amount of datums found in the cache instead of the network
+	answers   chan Reply                   // replies to every request in flight, from any source
+	rejection error                        // last ErrorReply to one of our requests
+	invalid   map[string]error             // why the datums received for a hash were refused
+	err       error                        // why the download stopped
+}
+
+func newDownloadEngine(conns []net.Conn) *downloadEngine {
+	e := &downloadEngine{
+		inflight:  make(map[requestKey]*datumRequest),
+		requested: make(map[string]bool),
+		values:    make(map[string][]byte),
+		invalid:   make(map[string]error),
+		answers:   make(chan Reply, downloadWindow*len(conns)+1),
+	}
+	for _, conn := range conns {
+		e.sources = append(e.sources, &downloadSource{
+			conn:    conn,
+			session: sessionOf(conn),
+			window:  1,
+			rto:     time.Second,
+			missing: make(map[string]bool),
+		})
+	}
+	return e
+}
+
+func (e *downloadEngine) enqueue(hash []byte) {
+	if e.requested[string(hash)] {
+		return
+	}
+	e.requested[string(hash)] = true
+	e.queue = append(e.queue, hash)
+}
+
+func (e *downloadEngine) send(r *datumRequest) {
+	logProgress("Asking " + r.source.conn.RemoteAddr().String() + " for hash : " + hex.EncodeToString(r.hash))
+	r.sent = time.Now()
+	if r.first.IsZero() {
+		r.first = r.sent
+	}
+	r.due = r.sent.Add(r.source.policy().wait(r.retries))
+	r.source.session.sent(r.id, MSG_GET_DATUM)
+	r.source.conn.Write(requestToByteSlice(buildDatumRequest(r.hash, r.id)))
+}
+
+/*
+	The retry policy of every request, starting from the retransmission timeout of this peer.
+*/
+
+func (src *downloadSource) policy() retryPolicy {
+	p := requestPolicy()
+	p.first = src.rto
+	p.retries = MAX_DATUM_RETRIES
+	return p
+}
+
+func (src *downloadSource) alive() bool {
+	return src.timeouts < MAX_DATUM_RETRIES
+}
+
+func (e *downloadEngine) anyAlive() bool {
+	for _, src := range e.sources {
+		if src.alive() {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Chooses the peer to ask for hash : the least busy of the peers still alive that may have it.
+	Returns nil if every such peer has a full window, and sets nobody when no peer can serve it at all.
+*/
+
+func (e *downloadEngine) pick(hash []byte, except *downloadSource) (best *downloadSource, nobody bool) {
+	nobody = true
+	for _, src := range e.sources {
+		if !src.alive() || src.missing[string(hash)] || src == except {
+			continue
+		}
+		nobody = false
+		if src.inflight >= int(src.window) {
+			continue
+		}
+		if best == nil || float64(src.inflight)/src.window < float64(best.inflight)/best.window {
+			best = src
+		}
+	}
+	return best, nobody
+}
+
+func (e *downloadEngine) dispatch(hash []byte, src *downloadSource, retries int, first time.Time) {
+	r := &datumRequest{hash: hash, id: src.session.newId(), source: src, retries: retries, first: first}
+	e.inflight[r.key()] = r
+	src.inflight++
+	src.session.await(r.id, e.answers)
+	e.send(r)
+}
+
+func (e *downloadEngine) forget(r *datumRequest) {
+	delete(e.inflight, r.key())
+	r.source.inflight--
+	r.source.session.abandon(r.id)
+}
+
+/*
+	Fills the windows of our peers with new requests taken from the queue.
+	Returns false when a hash can be served by none of them.
+*/
+
+func (e *downloadEngine) fill() bool {
+	for len(e.queue) > 0 {
+		hash := e.queue[0]
+		if value, found := loadDatum(hash); found {
+			e.queue = e.queue[1:]
+			e.fromCache++
+			e.accept(hash, value)
+			continue
+		}
+		src, nobody := e.pick(hash, nil)
+		if nobody {
+			e.err = &DatumError{hash, ErrNoDatum}
+			if e.rejection != nil {
+				e.err = &DatumError{hash, e.rejection}
+			}
+			if err, found := e.invalid[string(hash)]; found {
+				e.err = err
+			}
+			if !e.anyAlive() {
+				e.err = &DatumError{hash, ErrTimeout}
+			}
+			return false
+		}
+		if src == nil {
+			return true // every window is full, wait for replies
+		}
+		e.queue = e.queue[1:]
+		e.dispatch(hash, src, 0, time.Time{})
+	}
+	return true
+}
+
+func (src *downloadSource) updateRTT(sample time.Duration) {
+	if src.srtt == 0 {
+		src.srtt = sample
+		src.rttvar = sample / 2
+	} else {
+		delta := src.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		src.rttvar = (3*src.rttvar + delta) / 4
+		src.srtt = (7*src.srtt + sample) / 8
+	}
+	src.rto = src.srtt + 4*src.rttvar
+	if src.rto < MIN_RTO {
+		src.rto = MIN_RTO
+	}
+	if src.rto > MAX_RTO {
+		src.rto = MAX_RTO
+	}
+}
+
+/*
+	Handles every request whose timeout expired : it is given to another peer if one may have the
+	hash, and sent again to the same peer otherwise. A request is given up after MAX_DATUM_RETRIES
+	attempts or request_deadline, whoever they were sent to. Returns false when the download has to stop.
+*/
+
+func (e *downloadEngine) retransmit() bool {
+	now := time.Now()
+	late := make(map[*downloadSource]bool)
+	for _, r := range e.inflight {
+		src := r.source
+		if now.Before(r.due) {
+			continue
+		}
+		if src.policy().exhausted(r.first, r.retries, now) {
+			e.err = &DatumError{r.hash, ErrTimeout}
+			return false
+		}
+		if !late[src] {
+			late[src] = true
+			src.timeouts++
+			src.window = src.window / 2
+			if src.window < 1 {
+				src.window = 1
+			}
+			if !src.alive() {
+				fmt.Println("No reply from peer " + src.conn.RemoteAddr().String() + " : giving up on it.")
+			}
+		}
+		other, nobody := e.pick(r.hash, src)
+		if other != nil {
+			e.forget(r)
+			e.dispatch(r.hash, other, r.retries+1, r.first)
+			continue
+		}
+		if !src.alive() && !nobody {
+			e.forget(r)
+			e.queue = append([][]byte{r.hash}, e.queue...) // for the next peer with a free window
+			continue
+		}
+		if !src.alive() {
+			e.err = &DatumError{r.hash, fmt.Errorf("%w : no peer left to ask", ErrTimeout)}
+			return false
+		}
+		r.retries++
+		e.send(r)
+	}
+	return true
+}
+
+/*
+	Time at which the oldest request in flight has to be sent again.
+*/
+
+func (e *downloadEngine) nextDeadline() time.Time {
+	deadline := time.Now().Add(MAX_RTO)
+	for _, r := range e.inflight {
+		if r.due.Before(deadline) {
+			deadline = r.due
+		}
+	}
+	return deadline
+}
+
+/*
+	Handles a Datum, NoDatum or ErrorReply received from one of the sources. Returns false when the download has to stop.
+*/
+
+func (e *downloadEngine) receive(rep Reply) bool {
+	if rep.Frame.Type == MSG_ERROR_REPLY {
+		r, found := e.inflight[requestKey{rep.From, rep.Frame.Id}]
+		if !found {
+			return true
+		}
+		e.rejection = &RejectedError{rep.From.addr, msgTypeNames[MSG_GET_DATUM], string(rep.Frame.Body)}
+		logProgress(e.rejection.Error())
+		e.forget(r)
+		r.source.missing[string(r.hash)] = true
+		e.queue = append([][]byte{r.hash}, e.queue...) // ask someone else, fill() fails if nobody else may have it
+		return true
+	}
+	answer := rep.Packet
+	var hash, value []byte
+	var msgid uint32
+	nodatum := false
+	datum := &DatumMsg{}
+	if err := datum.Unmarshal(answer); err == nil {
+		msgid, hash, value = datum.Id, datum.Hash, append([]byte{}, datum.Value...)
+	} else {
+		missing := &GetDatumMsg{}
+		if missing.Unmarshal(answer) != nil || missing.Type != MSG_NO_DATUM {
+			return true // malformed, the request will be sent again
+		}
+		msgid, hash, nodatum = missing.Id, missing.Hash, true
+	}
+	r, found := e.inflight[requestKey{rep.From, msgid}]
+	if !found {
+		logProgress("Reply to an unknown or already answered request : skipping.")
+		return true
+	}
+	src := r.source
+	if !compareHash(r.hash, hash) {
+		communicateError(src.conn, "Not the data I asked for", 128, msgid)
+		e.distrust(r, &DatumError{r.hash, fmt.Errorf("%w : got a reply for hash %s", ErrProtocol, hex.EncodeToString(hash))})
+		return true
+	}
+	if !nodatum && !verifyDatum(r.hash, value) {
+		e.distrust(r, mismatchError(r.hash, value))
+		return true
+	}
+	e.forget(r)
+	src.timeouts = 0
+	if r.retries == 0 { // Karn's algorithm : ambiguous samples are ignored
+		src.updateRTT(time.Since(r.sent))
+	}
+	src.window = src.window + 1
+	if src.window > float64(downloadWindow) {
+		src.window = float64(downloadWindow)
+	}
+	if nodatum {
+		logProgress("Peer " + src.conn.RemoteAddr().String() + " does not have hash : " + hex.EncodeToString(hash))
+		src.missing[string(hash)] = true
+		e.queue = append([][]byte{r.hash}, e.queue...) // ask someone else first, fill() fails if nobody has it
+		return true
+	}
+	storeDatum(r.hash, value)
+	e.accept(r.hash, value)
+	return true
+}
+
+/*
+	A peer sent something else than the datum we asked it for : it is not asked for this hash
+	again, and the hash goes back to the queue for the other peers. fill() reports err if none
+	of them may have it.
+*/
+
+func (e *downloadEngine) distrust(r *datumRequest, err error) {
+	fmt.Println("Invalid datum from peer " + r.source.conn.RemoteAddr().String() + " : " + err.Error())
+	e.invalid[string(r.hash)] = err
+	e.forget(r)
+	r.source.missing[string(r.hash)] = true
+	e.queue = append([][]byte{r.hash}, e.queue...)
+}
+
+/*
+	Keeps a datum, received or found in the cache, and queues its children.
+*/
+
+func (e *downloadEngine) accept(hash []byte, value []byte) {
+	e.values[string(hash)] = value
+	switch value[0] {
+	case 1:
+		// Tree : every 32 bytes is the hash of a child
+		for i := 1; i+32 <= len(value); i = i + 32 {
+			e.enqueue(value[i : i+32])
+		}
+	case 2:
+		// Directory : every 64 bytes is a 32-byte name and a 32-byte hash
+		for i := 1; i+64 <= len(value); i = i + 64 {
+			e.enqueue(value[i+32 : i+64])
+		}
+	}
+}
+
+/*
+	Fetches every datum of the tree rooted at hash.
+*/
+
+func (e *downloadEngine) run(hash []byte) bool {
+	defer func() {
+		for _, r := range e.inflight {
+			e.forget(r) // late replies are dropped by the listener
+		}
+	}()
+	e.enqueue(hash)
+	for len(e.queue) > 0 || len(e.inflight) > 0 {
+		if !e.fill() {
+			return false
+		}
+		if len(e.inflight) == 0 {
+			continue // everything left was in the cache
+		}
+		timer := time.NewTimer(time.Until(e.nextDeadline()))
+		select {
+		case rep := <-e.answers:
+			if !e.receive(rep) {
+				timer.Stop()
+				return false
+			}
+		case <-timer.C:
+		}
+		timer.Stop()
+		if !e.retransmit() {
+			return false
+		}
+	}
+	return true
+}
+
+func datatypeName(datatype byte) string {
+	switch datatype {
+	case 0:
+		return "chunk"
+	case 1:
+		return "tree"
+	case 2:
+		return "directory"
+	}
+	return fmt.Sprintf("datum of unknown type %d", datatype)
+}
+
+func mismatchError(hash []byte, value []byte) error {
+	what := "empty datum"
+	if len(value) > 0 {
+		what = datatypeName(value[0])
+	}
+	return &DatumError{hash, fmt.Errorf("%w in a %s", ErrHashMismatch, what)}
+}
+
+func malformed(hash []byte, why string) (Node, error) {
+	return createDirectoryNode(""), &DatumError{hash, fmt.Errorf("%w : %s", ErrProtocol, why)}
+}
+
+/*
+	Rebuilds the Merkle tree from the received values, checking every hash on the way up.
+	Every value was already checked upon reception : rebuilding the node and hashing it again
+	makes sure that the tree we write to disk is exactly the one the peer announced.
+*/
+
+func (e *downloadEngine) assemble(Hash []byte) (Node, error) {
+	value, found := e.values[string(Hash)]
+	if !found {
+		return createDirectoryNode(""), &DatumError{Hash, ErrNoDatum}
+	}
+	datatype := value[0]
+	if debugmode {
+		fmt.Printf("Download Node : found datatype of %d\n", datatype)
+	}
+	var n Node
+	switch datatype {
+	case 0:
+		// Chunk
+		if len(value)-1 > 1024 {
+			return malformed(Hash, "chunk of more than 1024 bytes")
+		}
+		n = createChunkNode(value[1:], len(value)-1) // the datatype byte is not part of the data
+	case 1:
+		// Tree
+		if (len(value)-1)%32 != 0 || (len(value)-1)/32 < 2 || (len(value)-1)/32 > 32 {
+			return malformed(Hash, "tree without 2 to 32 hashes")
+		}
+		var bf []Node
+		for i := 1; i < len(value); i = i + 32 {
+			tmpc, tmpe := e.assemble(value[i : i+32])
+			if tmpe != nil {
+				return createDirectoryNode(""), tmpe
+			}
+			if tmpc.Directory {
+				return malformed(Hash, "directory inside a big file") // a big file only holds chunks and big files
+			}
+			bf = append(bf, tmpc) // this buffer stores every child of the Tree
+		}
+		n = createBigFileNode(bf, len(bf)) // transforms the buffer into a Bigfile node.
+	case 2:
+		// Directory
+		if (len(value)-1)%64 != 0 || (len(value)-1)/64 > 16 {
+			return malformed(Hash, "directory entries not of 64 bytes, or more than 16 of them")
+		}
+		n = createDirectoryNode("")
+		for i := 1; i < len(value); i = i + 64 {
+			name := value[i : i+32] // name of the entry, padded with zeroes
+			h := value[i+32 : i+64] // hash of the entry
+			tmpc, tmpe := e.assemble(h)
+			if tmpe != nil {
+				return createDirectoryNode(""), tmpe
+			}
+			tmpc.name = strings.TrimRight(string(name), "\x00")
+			n = AddChild(n, tmpc)
+		}
+	default:
+		return malformed(Hash, datatypeName(datatype))
+	}
+	if !compareHash(n.Hash, Hash) {
+		logProgress("Warning : non-matching hash. The data might be corrupted or incomplete.")
+		fmt.Printf("Expected hash : %s, got node hash : %s\n", string(hex.EncodeToString(Hash)), string(hex.EncodeToString(n.Hash)))
+		return createDirectoryNode(""), mismatchError(Hash, value)
+	}
+	return n, nil
+}
+
+/*
+	Downloads the whole tree rooted at Hash from the peer behind conn.
+*/
+
+func downloadNode(Hash []byte, conn net.Conn) (Node, error) {
+	return downloadSwarm(Hash, []net.Conn{conn})
+}
+
+/*
+	Downloads the whole tree rooted at Hash from several peers at once. Every peer is asked for
+	some of the hashes : those it does not have (NoDatum) or does not answer for are asked to the
+	others. Whoever sent it, every datum is checked against the Merkle hashes : one that does not
+	match is asked to the others too.
+*/
+
+func downloadSwarm(Hash []byte, conns []net.Conn) (Node, error) {
+	e := newDownloadEngine(conns)
+	start := time.Now()
+	if !e.run(Hash) {
+		return createDirectoryNode(""), e.err
+	}
+	logProgress(fmt.Sprintf("Fetched %d datums in %s, %d of them from the cache", len(e.values), time.Since(start), e.fromCache))
+	return e.assemble(Hash)
+}
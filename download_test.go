@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+/*
+	A peer serving tree on its own socket, which alters every datum it sends if corrupt is set.
+*/
+
+func servePeer(t *testing.T, tree Node, corrupt bool) net.Conn {
+	return fakePeer(t, func(frame *Frame) marshaler {
+		if frame.Type != MSG_GET_DATUM || len(frame.Body) != HASH_SIZE {
+			return nil
+		}
+		node := findNode(frame.Body, tree)
+		if node == nil {
+			return &GetDatumMsg{Id: frame.Id, Type: MSG_NO_DATUM, Hash: frame.Body}
+		}
+		value := datumValue(*node)
+		if corrupt {
+			value = append(value, 0)
+		}
+		return &DatumMsg{Id: frame.Id, Hash: node.Hash, Value: value}
+	})
+}
+
+func testTree(t *testing.T) Node {
+	dir := t.TempDir()
+	for i := 0; i < 8; i++ {
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), make([]byte, i*3000+1), 0644)
+	}
+	tree, err := createTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestSwarmSkipsCorruptPeer(t *testing.T) {
+	cacheDir = t.TempDir()
+	tree := testTree(t)
+	bad := servePeer(t, tree, true)
+	good := servePeer(t, tree, false)
+	n, err := downloadSwarm(tree.Hash, []net.Conn{bad, good})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compareHash(n.Hash, tree.Hash) {
+		t.Fatal("downloaded another tree")
+	}
+}
+
+func TestDownloadFromCorruptPeer(t *testing.T) {
+	cacheDir = t.TempDir()
+	tree := testTree(t)
+	_, err := downloadNode(tree.Hash, servePeer(t, tree, true))
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatal("expected a hash mismatch, got ", err)
+	}
+}
+
+/*
+	A peer serving tree, but none of the sub-tree withheld, which counts the datums it sends.
+*/
+
+func partialPeer(t *testing.T, tree Node, withheld []byte, sent *atomic.Int32) net.Conn {
+	return fakePeer(t, func(frame *Frame) marshaler {
+		node := findNode(frame.Body, tree)
+		if frame.Type != MSG_GET_DATUM || node == nil || compareHash(frame.Body, withheld) {
+			return &GetDatumMsg{Id: frame.Id, Type: MSG_NO_DATUM, Hash: frame.Body}
+		}
+		sent.Add(1)
+		return &DatumMsg{Id: frame.Id, Hash: node.Hash, Value: datumValue(*node)}
+	})
+}
+
+func TestDownloadResumesFromCache(t *testing.T) {
+	cacheDir = t.TempDir()
+	tree := testTree(t)
+	var before, after atomic.Int32
+	last := tree.Childs[len(tree.Childs)-1]
+	if _, err := downloadNode(tree.Hash, partialPeer(t, tree, last.Hash, &before)); err == nil {
+		t.Fatal("downloaded a tree missing a file")
+	}
+	var cached []cacheEntry
+	scanCache(&cached)
+	n, err := downloadNode(tree.Hash, partialPeer(t, tree, nil, &after))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compareHash(n.Hash, tree.Hash) {
+		t.Fatal("downloaded another tree")
+	}
+	// the same download with an empty cache, for the amount of datums of the tree
+	cacheDir = t.TempDir()
+	var all atomic.Int32
+	if _, err := downloadNode(tree.Hash, partialPeer(t, tree, nil, &all)); err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) == 0 || int(after.Load()) > int(all.Load())-len(cached) {
+		t.Fatalf("%d datums fetched again after %d of %d were cached", after.Load(), len(cached), all.Load())
+	}
+}
+
+func TestCorruptedCacheEntryIsRemoved(t *testing.T) {
+	cacheDir = t.TempDir()
+	node := createChunkNode([]byte("some data"), 9)
+	value := datumValue(node)
+	storeDatum(node.Hash, value)
+	if cached, ok := loadDatum(node.Hash); !ok || string(cached) != string(value) {
+		t.Fatal("datum not cached")
+	}
+	os.WriteFile(cachePath(node.Hash), append(value, 0), 0600)
+	if _, ok := loadDatum(node.Hash); ok {
+		t.Fatal("loaded a corrupted datum")
+	}
+	if _, err := os.Stat(cachePath(node.Hash)); !os.IsNotExist(err) {
+		t.Fatal("corrupted datum still in cache : ", err)
+	}
+}
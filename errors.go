@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+)
+
+/*
+	ERRORS
+*/
+
+/*
+	Every failure is reported as one of these errors, wrapped with its context, so that callers
+	can tell them apart with errors.Is and errors.As instead of comparing status strings :
+	- ErrTimeout : the server or a peer did not answer in time ;
+	- ErrRejected : the server or a peer answered our request with an ErrorReply ;
+	- ErrNoDatum : the peer does not have the datum we asked for ;
+	- ErrHashMismatch : a datum, or the tree built from it, does not match its hash ;
+	- ErrBadSignature : a message is not signed, or not by the key its sender published ;
+	- ErrProtocol : a message that does not follow the protocol (see also the codec errors) ;
+	- ErrNotFound : the REST server does not know this peer ;
+	- ErrServer : the REST server could not be reached or answered an unexpected status ;
+	- ErrKeyFile, ErrPassphrase : a key file we cannot read, or cannot decrypt ;
+	- ErrKeyChanged : the key of a peer is not the one we pinned on first use ;
+	- ErrBadName : a peer name we cannot pin, as it holds whitespace or control characters ;
+	- ErrWrite : a downloaded tree could not be written to the disk.
+*/
+
+var ErrTimeout = errors.New("no reply in time")
+var ErrRejected = errors.New("request rejected")
+var ErrNoDatum = errors.New("datum not found")
+var ErrHashMismatch = errors.New("hash mismatch")
+var ErrBadSignature = errors.New("bad signature")
+var ErrProtocol = errors.New("protocol violation")
+var ErrNotFound = errors.New("unknown peer")
+var ErrServer = errors.New("REST server error")
+var ErrKeyFile = errors.New("invalid key file")
+var ErrPassphrase = errors.New("wrong passphrase, or corrupted key file")
+var ErrKeyChanged = errors.New("key changed")
+var ErrBadName = errors.New("invalid peer name")
+var ErrWrite = errors.New("unable to write the download")
+
+/*
+	An error about one datum of a tree.
+*/
+
+type DatumError struct {
+	Hash []byte
+	Err  error
+}
+
+func (e *DatumError) Error() string {
+	return e.Err.Error() + " for hash " + hex.EncodeToString(e.Hash)
+}
+
+func (e *DatumError) Unwrap() error {
+	return e.Err
+}
+
+/*
+	An ErrorReply to one of our UDP requests, with the message of the server or the peer.
+*/
+
+type RejectedError struct {
+	Addr    string
+	Request string // type of our request
+	Message string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s rejected our %s : %s", e.Addr, e.Request, e.Message)
+}
+
+func (e *RejectedError) Unwrap() error {
+	return ErrRejected
+}
+
+/*
+	An error about one request to the REST server.
+*/
+
+type RESTError struct {
+	URL    string
+	Status int // 0 if no reply was received
+	Err    error
+}
+
+func (e *RESTError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("%s : status %d : %s", e.URL, e.Status, e.Err)
+	}
+	return e.URL + " : " + e.Err.Error()
+}
+
+func (e *RESTError) Unwrap() error {
+	return e.Err
+}
+
+/*
+	Turns an error from the network stack into ErrTimeout when it is a timeout, keeping the original.
+*/
+
+func networkError(err error) error {
+	var e net.Error
+	if errors.As(err, &e) && e.Timeout() {
+		return fmt.Errorf("%w : %w", ErrTimeout, err)
+	}
+	return fmt.Errorf("%w : %w", ErrServer, err)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	FAULT INJECTION
+*/
+
+/*
+	Every datagram we send or receive, and every REST request, goes through the fault injector.
+	For each message type, a rule gives the rates at which datagrams are dropped, duplicated,
+	reordered (sent after the next datagram) or corrupted (one bit flipped), and a delay.
+	Rules are keyed by message type name (see msgTypeNames), "all" for every datagram, or
+	"http" for the REST client, on which only drop, delay and corrupt make sense.
+	Decisions are drawn from seeded generators, one for the datagrams we send, one for those we
+	receive and one for the REST client : the faults of a direction only depend on the seed and
+	on the traffic in this direction, whatever the order the goroutines of the other ones run in.
+	The fault command sets rules from the CLI, setFault from Go code.
+	The injector can also put us behind a simulated NAT : datagrams from an address we never wrote
+	to are dropped on reception, like a NAT filtering by endpoint does. Two clients on the same
+	machine can thus go through a NAT traversal with the rendezvous stand-in.
+*/
+
+type faultRule struct {
+	drop      float64
+	duplicate float64
+	reorder   float64
+	corrupt   float64
+	delay     time.Duration
+}
+
+type faultDirection int
+
+const (
+	FAULT_SEND faultDirection = iota
+	FAULT_RECEIVE
+	FAULT_HTTP
+)
+
+type faultInjector struct {
+	mutex sync.Mutex
+	rngs  [3]*rand.Rand // by direction
+	rules map[string]*faultRule
+	held  [2][]func()     // reordered datagrams, sent after the next one in the same direction
+	nat   bool            // simulated NAT
+	open  map[string]bool // addresses we wrote to, let through the simulated NAT
+}
+
+var faults = newFaultInjector(1)
+
+var msgTypeNames = map[byte]string{
+	MSG_NOOP:                  "noop",
+	MSG_ERROR:                 "error",
+	MSG_HELLO:                 "hello",
+	MSG_PUBLIC_KEY:            "publickey",
+	MSG_ROOT:                  "root",
+	MSG_GET_DATUM:             "getdatum",
+	MSG_NAT_TRAVERSAL_REQUEST: "natrequest",
+	MSG_NAT_TRAVERSAL:         "nat",
+	MSG_ERROR_REPLY:           "errorreply",
+	MSG_HELLO_REPLY:           "helloreply",
+	MSG_PUBLIC_KEY_REPLY:      "publickeyreply",
+	MSG_ROOT_REPLY:            "rootreply",
+	MSG_DATUM:                 "datum",
+	MSG_NO_DATUM:              "nodatum",
+}
+
+func newFaultInjector(seed int64) *faultInjector {
+	f := &faultInjector{
+		rules: make(map[string]*faultRule),
+		open:  make(map[string]bool),
+	}
+	f.seed(seed)
+	return f
+}
+
+/*
+	Restarts the generator of every direction from seed. Must be called with f.mutex held.
+*/
+
+func (f *faultInjector) seed(seed int64) {
+	for d := range f.rngs {
+		f.rngs[d] = rand.New(rand.NewSource(seed*int64(len(f.rngs)) + int64(d)))
+	}
+}
+
+func validFaultTarget(target string) bool {
+	if target == "all" || target == "http" {
+		return true
+	}
+	for _, name := range msgTypeNames {
+		if name == target {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Sets one fault for a target : action is drop, duplicate, reorder or corrupt with a rate
+	between 0 and 1, or delay with a duration.
+*/
+
+func (f *faultInjector) setFault(target string, action string, value string) error {
+	if !validFaultTarget(target) {
+		return fmt.Errorf("unknown message type %q", target)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rule, exists := f.rules[target]
+	if !exists {
+		rule = &faultRule{}
+		f.rules[target] = rule
+	}
+	if action == "delay" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid delay %q", value)
+		}
+		rule.delay = d
+		return nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return fmt.Errorf("invalid rate %q, expected a number between 0 and 1", value)
+	}
+	switch action {
+	case "drop":
+		rule.drop = rate
+	case "duplicate":
+		rule.duplicate = rate
+	case "reorder":
+		rule.reorder = rate
+	case "corrupt":
+		rule.corrupt = rate
+	default:
+		return fmt.Errorf("unknown fault %q", action)
+	}
+	return nil
+}
+
+/*
+	Removes every rule and restarts the generator from seed.
+*/
+
+func (f *faultInjector) reset(seed int64) {
+	f.mutex.Lock()
+	held := append(f.held[FAULT_SEND], f.held[FAULT_RECEIVE]...)
+	f.seed(seed)
+	f.rules = make(map[string]*faultRule)
+	f.held = [2][]func(){}
+	f.nat = false
+	f.mutex.Unlock()
+	for _, send := range held {
+		send()
+	}
+}
+
+func (f *faultInjector) print() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.nat {
+		fmt.Println("Behind a simulated NAT.")
+	}
+	if len(f.rules) == 0 {
+		if !f.nat {
+			fmt.Println("No fault injected.")
+		}
+		return
+	}
+	var targets []string
+	for target := range f.rules {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		r := f.rules[target]
+		fmt.Printf("%s : drop %g, duplicate %g, reorder %g, corrupt %g, delay %s\n", target, r.drop, r.duplicate, r.reorder, r.corrupt, r.delay)
+	}
+}
+
+/*
+	Simulated NAT : opened is called for every datagram we send, filtered for every one we receive.
+*/
+
+func (f *faultInjector) opened(addr string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.open[addr] = true
+}
+
+func (f *faultInjector) filtered(addr string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.nat && !f.open[addr]
+}
+
+/*
+	Rule for a target, merged with the "all" rule for datagrams. Must be called with f.mutex held.
+*/
+
+func (f *faultInjector) ruleFor(target string) (faultRule, bool) {
+	var rules []*faultRule
+	if r, found := f.rules[target]; found {
+		rules = append(rules, r)
+	}
+	if r, found := f.rules["all"]; found && target != "http" {
+		rules = append(rules, r)
+	}
+	merged := faultRule{}
+	for _, r := range rules {
+		merged.drop = max(merged.drop, r.drop)
+		merged.duplicate = max(merged.duplicate, r.duplicate)
+		merged.reorder = max(merged.reorder, r.reorder)
+		merged.corrupt = max(merged.corrupt, r.corrupt)
+		merged.delay = max(merged.delay, r.delay)
+	}
+	return merged, len(rules) > 0
+}
+
+func (f *faultInjector) roll(dir faultDirection, rate float64) bool {
+	return rate > 0 && f.rngs[dir].Float64() < rate
+}
+
+/*
+	Flips one random bit of a copy of packet, in its body if it has one.
+	Must be called with f.mutex held.
+*/
+
+func (f *faultInjector) corrupted(dir faultDirection, packet []byte) []byte {
+	rng := f.rngs[dir]
+	res := append([]byte{}, packet...)
+	if len(res) == 0 {
+		return res
+	}
+	i := rng.Intn(len(res))
+	if len(res) > HEADER_SIZE {
+		i = HEADER_SIZE + rng.Intn(len(res)-HEADER_SIZE)
+	}
+	res[i] = res[i] ^ (1 << rng.Intn(8))
+	return res
+}
+
+/*
+	Hands a datagram going in direction dir (FAULT_SEND or FAULT_RECEIVE) to send, after
+	applying the faults of its message type.
+*/
+
+func (f *faultInjector) inject(dir faultDirection, packet []byte, send func([]byte)) {
+	target := "unknown"
+	if len(packet) > 4 {
+		if name, known := msgTypeNames[packet[4]]; known {
+			target = name
+		}
+	}
+	f.mutex.Lock()
+	held := f.held[dir]
+	f.held[dir] = nil
+	rule, active := f.ruleFor(target)
+	if !active {
+		f.mutex.Unlock()
+		send(packet)
+		for _, h := range held {
+			h()
+		}
+		return
+	}
+	drop := f.roll(dir, rule.drop)
+	copies := 1
+	if f.roll(dir, rule.duplicate) {
+		copies = 2
+	}
+	if f.roll(dir, rule.corrupt) {
+		packet = f.corrupted(dir, packet)
+	}
+	reorder := f.roll(dir, rule.reorder)
+	f.mutex.Unlock()
+	deliver := func() {
+		for i := 0; i < copies; i++ {
+			send(packet)
+		}
+	}
+	switch {
+	case drop:
+		logProgress("Fault injection : dropping a " + target)
+	case reorder:
+		logProgress("Fault injection : holding a " + target + " until the next datagram")
+		f.mutex.Lock()
+		f.held[dir] = append(f.held[dir], deliver)
+		f.mutex.Unlock()
+		time.AfterFunc(MIN_RTO, func() { f.flush(dir) }) // do not hold it forever if nothing else is sent
+	case rule.delay > 0:
+		time.AfterFunc(rule.delay, deliver)
+	default:
+		deliver()
+	}
+	for _, h := range held {
+		h()
+	}
+}
+
+func (f *faultInjector) flush(dir faultDirection) {
+	f.mutex.Lock()
+	held := f.held[dir]
+	f.held[dir] = nil
+	f.mutex.Unlock()
+	for _, h := range held {
+		h()
+	}
+}
+
+/*
+	The same faults on the REST client : a dropped request times out, a corrupted one gets
+	a reply with one bit flipped.
+*/
+
+type faultTransport struct {
+	base http.RoundTripper
+}
+
+type injectedTimeout struct{}
+
+func (injectedTimeout) Error() string   { return "fault injection : request dropped" }
+func (injectedTimeout) Timeout() bool   { return true }
+func (injectedTimeout) Temporary() bool { return true }
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	faults.mutex.Lock()
+	rule, active := faults.ruleFor("http")
+	drop := active && faults.roll(FAULT_HTTP, rule.drop)
+	corrupt := active && faults.roll(FAULT_HTTP, rule.corrupt)
+	faults.mutex.Unlock()
+	if active && rule.delay > 0 {
+		time.Sleep(rule.delay)
+	}
+	if drop {
+		logProgress("Fault injection : dropping a request to " + req.URL.String())
+		return nil, injectedTimeout{}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !corrupt {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	faults.mutex.Lock()
+	body = faults.corrupted(FAULT_HTTP, append([]byte("0000000"), body...))[HEADER_SIZE:] // anywhere in the body
+	faults.mutex.Unlock()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+/*
+	fault command : fault <type|all|http> <drop|duplicate|reorder|corrupt> <rate>,
+	fault <type|all|http> delay <duration>, fault nat-sim on|off, fault off [seed], or fault alone
+	to list the rules.
+*/
+
+func faultCommand(args []string) {
+	if len(args) == 0 {
+		faults.print()
+		return
+	}
+	if args[0] == "off" {
+		var seed int64 = 1
+		if len(args) > 1 {
+			s, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				fmt.Println("Invalid seed : " + args[1])
+				return
+			}
+			seed = s
+		}
+		faults.reset(seed)
+		return
+	}
+	if args[0] == "nat-sim" && len(args) == 2 && (args[1] == "on" || args[1] == "off") {
+		faults.mutex.Lock()
+		faults.nat = args[1] == "on"
+		faults.mutex.Unlock()
+		return
+	}
+	if len(args) != 3 {
+		fmt.Println("Usage : fault <type|all|http> <drop|duplicate|reorder|corrupt> <rate>, fault <type|all|http> delay <duration>, fault nat-sim on|off, fault off [seed]")
+		return
+	}
+	if err := faults.setFault(strings.ToLower(args[0]), args[1], args[2]); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"testing"
+)
+
+func testPacket(msgtype byte, n int) []byte {
+	return []byte{0, 0, 0, byte(n), msgtype, 0, 2, byte(n >> 8), byte(n)}
+}
+
+/*
+	Sends count datagrams of msgtype through f in direction dir, and returns what comes out.
+*/
+
+func injectAll(f *faultInjector, dir faultDirection, msgtype byte, count int) [][]byte {
+	var out [][]byte
+	for i := 0; i < count; i++ {
+		f.inject(dir, testPacket(msgtype, i), func(packet []byte) {
+			out = append(out, packet)
+		})
+	}
+	return out
+}
+
+func TestFaultsDependOnlyOnTheSeed(t *testing.T) {
+	a := newFaultInjector(42)
+	b := newFaultInjector(42)
+	for _, f := range []*faultInjector{a, b} {
+		f.setFault("all", "drop", "0.5")
+		f.setFault("all", "duplicate", "0.3")
+	}
+	// b also receives datagrams meanwhile : what we send must not change
+	sentA := injectAll(a, FAULT_SEND, MSG_GET_DATUM, 200)
+	injectAll(b, FAULT_RECEIVE, MSG_DATUM, 37)
+	sentB := injectAll(b, FAULT_SEND, MSG_GET_DATUM, 200)
+	if fmt.Sprint(sentA) != fmt.Sprint(sentB) {
+		t.Fatal("the same seed and traffic gave other faults")
+	}
+	if len(sentA) == 0 || len(sentA) == 200 {
+		t.Fatal("no fault injected : ", len(sentA))
+	}
+	c := newFaultInjector(43)
+	c.setFault("all", "drop", "0.5")
+	c.setFault("all", "duplicate", "0.3")
+	if fmt.Sprint(injectAll(c, FAULT_SEND, MSG_GET_DATUM, 200)) == fmt.Sprint(sentA) {
+		t.Fatal("another seed gave the same faults")
+	}
+}
+
+func TestFaultRules(t *testing.T) {
+	f := newFaultInjector(1)
+	f.setFault("hello", "drop", "1")
+	if out := injectAll(f, FAULT_SEND, MSG_HELLO, 10); len(out) != 0 {
+		t.Fatal("dropped Hello sent : ", len(out))
+	}
+	if out := injectAll(f, FAULT_SEND, MSG_ROOT, 10); len(out) != 10 {
+		t.Fatal("the Hello rule applies to Root : ", len(out))
+	}
+	f.setFault("root", "duplicate", "1")
+	if out := injectAll(f, FAULT_RECEIVE, MSG_ROOT, 10); len(out) != 20 {
+		t.Fatal("Root not duplicated : ", len(out))
+	}
+	f.setFault("datum", "corrupt", "1")
+	for i, packet := range injectAll(f, FAULT_RECEIVE, MSG_DATUM, 10) {
+		flipped := 0
+		for j, b := range packet {
+			flipped += bits.OnesCount8(b ^ testPacket(MSG_DATUM, i)[j])
+		}
+		if flipped != 1 || !bytes.Equal(packet[:HEADER_SIZE], testPacket(MSG_DATUM, i)[:HEADER_SIZE]) {
+			t.Fatalf("corrupted %x into %x", testPacket(MSG_DATUM, i), packet)
+		}
+	}
+	for _, bad := range [][]string{{"hi", "drop", "1"}, {"all", "drop", "2"}, {"all", "lose", "1"}, {"http", "delay", "soon"}} {
+		if err := f.setFault(bad[0], bad[1], bad[2]); err == nil {
+			t.Fatal("accepted the fault ", bad)
+		}
+	}
+}
+
+func TestFaultReorder(t *testing.T) {
+	f := newFaultInjector(1)
+	f.setFault("hello", "reorder", "1")
+	var out []byte
+	send := func(packet []byte) { out = append(out, packet[4]) }
+	f.inject(FAULT_SEND, testPacket(MSG_HELLO, 0), send)
+	f.inject(FAULT_RECEIVE, testPacket(MSG_ROOT, 1), send) // other direction : the Hello stays held
+	f.inject(FAULT_SEND, testPacket(MSG_ROOT, 2), send)
+	if !bytes.Equal(out, []byte{MSG_ROOT, MSG_ROOT, MSG_HELLO}) {
+		t.Fatal("reordered into ", out)
+	}
+}
+
+func TestNatSimulation(t *testing.T) {
+	f := newFaultInjector(1)
+	if f.filtered("192.0.2.1:8443") {
+		t.Fatal("filtered without a NAT")
+	}
+	f.nat = true
+	if !f.filtered("192.0.2.1:8443") {
+		t.Fatal("not filtered before writing to it")
+	}
+	f.opened("192.0.2.1:8443")
+	if f.filtered("192.0.2.1:8443") || !f.filtered("192.0.2.1:8444") {
+		t.Fatal("the NAT opened for another address")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"unicode/utf8"
 )
 
 type Node struct {
@@ -25,14 +26,15 @@ type Node struct {
 */
 
 func filename(filepath string) string {
-	// macro removing the trailing slash in filepaths
+	// macro removing the leading directories and the trailing slash in filepaths
+	filepath = strings.TrimRight(filepath, "/")
 	i := strings.LastIndex(filepath, "/")
 	if i == -1 {
 		// if no slash at all, then the file name is the full string
 		return filepath
 	} else {
 		// otherwise, the file name is the last word of the slash-delimited string
-		return filepath[i:]
+		return filepath[i+1:]
 	}
 }
 
@@ -42,99 +44,165 @@ func filename(filepath string) string {
 func createNode(filepath string) Node {
 	// open a file on the disk
 	f, err := os.Open(filepath)
-	if err != nil || force_err {
+	if err != nil {
 		fmt.Println(err)
+		return Node{}
 	}
 	defer f.Close()
-	reader := bufio.NewReader(f)    // a reader on our file
-	buf := make([]byte, 1024)       // this buffer will serve to read our file
-	chunkbuffer := make([]Node, 32) // an empty Node array (will store the children of our final Node)
-	var chunkchildren, bigfilechildren int = 0, 0
-	// i is a counter for the amount of reads done on the file. It tracks the current amount of chunks among the children
-	// As every read creates a child, it is important to track this amount, to convert a large amount of data chunks into a big file
-	// Similarly, j tracks the amount of big files among the children
-	var bigfilebuffer []Node // bf stores the big files we created
+	reader := bufio.NewReader(f) // a reader on our file
+	var buffer []Node            // the nodes of the current depth, starting with the chunks
 	for {
-		n, err := reader.Read(buf) // reads the file
-		if err != nil || force_err {
-			if err != io.EOF {
-				fmt.Println(err)
-				return Node{}
-			}
+		buf := make([]byte, 1024) // a fresh buffer for every chunk, as the chunk keeps a reference to it
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			buffer = append(buffer, createChunkNode(buf, n))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break // when EOF reached, skip to the next part
 		}
-		if chunkchildren == 32 { // when we have too many chunks, convert them into a single big file
-			bigfilebuffer = append(bigfilebuffer, createBigFileNode(chunkbuffer, 32))
-			chunkchildren = 0                     // resets the chunk children counter
-			bigfilechildren = bigfilechildren + 1 // increments the big file children counter
+		if err != nil {
+			fmt.Println(err)
+			return Node{}
 		}
-		chunkbuffer[chunkchildren] = createChunkNode(buf, n)
-		chunkchildren = chunkchildren + 1
 	}
-	// Now that we created buffers and counters for both chunks and big files, we need to group the leftover chunks one last time
-	if bigfilechildren == 0 { // if we have no big file
-		if chunkchildren > 1 { // and several chunks
-			ret := createBigFileNode(chunkbuffer, chunkchildren) // group them under one big file
-			ret.name = filename(filepath)
-			return ret // and directly return it
-		} else {
-			chunkbuffer[0].name = filename(filepath) // if we have no big file and only one chunk, keep it as is
-			return chunkbuffer[0]                    // and return this single chunk
-		}
+	if len(buffer) == 0 { // an empty file is a single empty chunk
+		buffer = append(buffer, createChunkNode([]byte{}, 0))
 	}
-	// in this part, we already have at least one big file, and possibly some leftover chunks : we will need to group them adequately
-	fmt.Printf("Amount of Big Files : %d\n", bigfilechildren)
-	fmt.Printf("Amount of leftover Chunks : %d\n", chunkchildren)
-	bigfilebuffer = append(bigfilebuffer, createBigFileNode(chunkbuffer, chunkchildren)) // merging leftover chunks into a final big file node
 	/*
-		In this part, we will use conjunctively two buffers to enforce the "32 max children" rule.
-		One will be our bigfilebuffer, re-used.
-		The second one will be our next_depth_buf.
-		We will group the children of bigfilebuffer into a new, next-depth, Node when there are too many.
-		We will then store these next-depth nodes into next_depth_buf.
-		This next_depth_buf will then become our new bigfilebuffer, and so on.
-		We are done when the 32-children cap is no longer broken.
+		We group the nodes of the current depth by 32 (the children cap of a big file) into next-depth nodes,
+		and start again on the next depth until a single node remains : this node is our file.
+		A group of a single node is moved up as is, since a big file needs at least 2 children.
 	*/
-	var next_depth_buf []Node
-	for len(bigfilebuffer) > 32 {
-		for a := 0; a < len(bigfilebuffer); a = a + 32 { // iterates by groups of 32 due to 32 being the children cap
-			next_depth_buf = append(next_depth_buf, createBigFileNode(bigfilebuffer[a:32], 32)) // groups are placed into our next_depth buffer
+	for len(buffer) > 1 {
+		var next_depth_buf []Node
+		for a := 0; a < len(buffer); a = a + 32 {
+			b := a + 32
+			if b > len(buffer) {
+				b = len(buffer)
+			}
+			if b-a == 1 {
+				next_depth_buf = append(next_depth_buf, buffer[a])
+			} else {
+				next_depth_buf = append(next_depth_buf, createBigFileNode(buffer[a:b], b-a))
+			}
+		}
+		buffer = next_depth_buf
+	}
+	ret := buffer[0]
+	ret.name = filename(filepath)
+	return ret
+}
+
+/*
+	Returns a Merkle tree Node for a given path, walking the disk recursively if it points to a directory.
+*/
+func createTree(path string) (Node, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Node{}, err
+	}
+	if !info.IsDir() {
+		n := createNode(path)
+		if n.Hash == nil {
+			return Node{}, fmt.Errorf("unable to read %s", path)
+		}
+		return n, nil
+	}
+	entries, err := os.ReadDir(path) // sorted by name, so that the same directory always gives the same hash
+	if err != nil {
+		return Node{}, err
+	}
+	var children []Node
+	taken := make(map[string]bool)
+	for _, entry := range entries {
+		taken[entry.Name()] = true
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			logProgress("Skipping " + entry.Name() + " : neither a file nor a directory")
+			continue
+		}
+		c, err := createTree(path + "/" + entry.Name())
+		if err != nil {
+			return Node{}, err
 		}
-		bigfilebuffer = nil                 // resets the current array to nil
-		copy(bigfilebuffer, next_depth_buf) // and sets former next-depth buffer as current depth
+		c.name = entry.Name()
+		if len(c.name) > 32 { // names are stored on 32 bytes in a directory entry
+			c.name = shortName(c.name, taken)
+			taken[c.name] = true
+			fmt.Println("Warning : name too long, shared as " + c.name + " : " + entry.Name())
+		}
+		children = append(children, c)
 	}
-	if len(bigfilebuffer) >= 2 { // big file merger : groups leftover big file nodes
-		ret := createBigFileNode(bigfilebuffer, len(bigfilebuffer))
-		ret.name = filename(filepath)
-		return ret
-	} else { // in case of a single big file remaining, returns it instead
-		bigfilebuffer[0].name = filename(filepath)
-		return bigfilebuffer[0]
+	ret := groupDirectory(children)
+	ret.name = filename(path)
+	return ret, nil
+}
+
+/*
+	Returns name cut to 32 bytes without splitting a character, and ended with ~1, ~2... if
+	another entry of the directory already has this name.
+*/
+func shortName(name string, taken map[string]bool) string {
+	for i := 0; ; i++ {
+		suffix := ""
+		if i > 0 {
+			suffix = fmt.Sprintf("~%d", i)
+		}
+		short := name
+		for len(short)+len(suffix) > 32 {
+			_, size := utf8.DecodeLastRuneInString(short)
+			short = short[:len(short)-size]
+		}
+		if !taken[short+suffix] {
+			return short + suffix
+		}
 	}
 }
 
+/*
+	The protocol does not support directories of more than 16 entries.
+	Bigger directories are split into sub-directories of 16 entries named part1, part2...,
+	themselves grouped again if there are more than 16 of them.
+*/
+func groupDirectory(children []Node) Node {
+	if len(children) <= 16 {
+		n := createDirectoryNode("")
+		for i := 0; i < len(children); i++ {
+			n = AddChild(n, children[i])
+		}
+		return n
+	}
+	var parts []Node
+	for a := 0; a < len(children); a = a + 16 {
+		b := a + 16
+		if b > len(children) {
+			b = len(children)
+		}
+		part := groupDirectory(children[a:b])
+		part.name = fmt.Sprintf("part%d", len(parts)+1)
+		parts = append(parts, part)
+	}
+	return groupDirectory(parts)
+}
+
+/*
+	Every node is identified by the SHA-256 hash of its Datum value, datatype byte included (see datumValue).
+	These builders compute it the same way for the nodes we export and the nodes we download.
+*/
+
 func createChunkNode(content []byte, length int) Node {
-	h := sha256.New()
-	/* 	tmpc := []byte{}
-	   	t := make([]byte, 1)
-	   	   	t[0] = 0 // Chunk type */
-	data := content[0:length]
-	h.Write(data) // TODO check if hash is computed solely on data or on type + data
-	return Node{
+	n := Node{
 		Directory: false,
 		Big:       false,
 		Parent:    nil,
-		Hash:      h.Sum(nil),
-		Data:      data,
+		Data:      content[0:length], // raw data, without the datatype byte
 	}
+	n.Hash = hashValue(datumValue(n))
+	return n
 }
 
 func createBigFileNode(children []Node, nb int) Node {
-	s := []byte{}
-	h := sha256.New()
-	t := make([]byte, 1)
-	t[0] = 1
-	s = append(s, t[0])
 	n := Node{
 		Directory: false,
 		Big:       true,
@@ -142,12 +210,10 @@ func createBigFileNode(children []Node, nb int) Node {
 		Childs:    make([]Node, nb),
 	}
 	for i := 0; i < nb; i++ {
-		s = append(s, children[i].Hash...)
 		n.Childs[i] = children[i]
 		n.Childs[i].Parent = &n
 	}
-	h.Write(s)
-	n.Hash = h.Sum(nil)
+	n.Hash = hashValue(datumValue(n))
 	return n
 }
 
@@ -171,24 +237,12 @@ func AddChild(p Node, c Node) Node {
 		c.Parent = &p
 		p.Childs = append(p.Childs, c)
 		p.nbchild = p.nbchild + 1
-		h := sha256.New()
-		s := make([]byte, 0)
-		/* 		s := make([]byte, 1)
-		   		s[0] = 2 */
-
-		for i := 0; i < p.nbchild; i++ {
-			s = append(s, []byte(p.Childs[i].name)...)
-			s = append(s, p.Childs[i].Hash...)
-
-		}
-		h.Write(s)
-		p.Hash = h.Sum(nil)
-
+		p.Hash = hashValue(datumValue(p))
 	}
 	return p
 }
 func createDirectoryNode(n string) Node {
-	return Node{
+	ret := Node{
 		Directory: true,
 		Big:       false,
 		nbchild:   0,
@@ -196,6 +250,38 @@ func createDirectoryNode(n string) Node {
 		name:      n,
 		Childs:    make([]Node, 0),
 	}
+	ret.Hash = hashValue(datumValue(ret)) // hash of an empty directory, updated by AddChild
+	return ret
+}
+
+/*
+	Returns the Value field of the Datum describing this node : the datatype byte followed by
+	the raw data (Chunk), the children hashes (Tree) or the 64-byte entries (Directory).
+*/
+func datumValue(n Node) []byte {
+	if n.Directory {
+		value := []byte{2}
+		for i := 0; i < n.nbchild; i++ {
+			entryname := make([]byte, 32) // names are padded with zeroes up to 32 bytes
+			copy(entryname, []byte(n.Childs[i].name))
+			value = append(value, entryname...)
+			value = append(value, n.Childs[i].Hash...)
+		}
+		return value
+	}
+	if n.Big {
+		value := []byte{1}
+		for i := 0; i < n.nbchild; i++ {
+			value = append(value, n.Childs[i].Hash...)
+		}
+		return value
+	}
+	return append([]byte{0}, n.Data...)
+}
+
+func hashValue(value []byte) []byte {
+	h := sha256.Sum256(value)
+	return h[:]
 }
 
 /* func PrintTree(r Node, pre string) {
@@ -225,42 +311,35 @@ func WriteFile(current Node) []byte {
 		}
 		return s
 	} else {
-		return current.Data[1:] // remove datatype
+		return current.Data
 	}
 	// return -1 -> unreachable code
 }
-func WriteArbo(r Node, path string) int {
+func WriteArbo(r Node, path string) error {
 	if r.Directory {
 		err := os.MkdirAll(path, 0777)
 		if err != nil {
-			fmt.Println("on essaie de creer un dossier")
-			panic(err)
+			return fmt.Errorf("%w : %w", ErrWrite, err) // e.g. a file in the way of the directory
 		}
 		for i := 0; i < r.nbchild; i++ {
-			fullpath := fmt.Sprintf(path+"/"+"%d", i)
-			WriteArbo(r.Childs[i], fullpath)
+			childname := r.Childs[i].name
+			if !validName(childname) { // a peer may send names such as "..", never write outside of path
+				childname = fmt.Sprintf("%d", i)
+			}
+			if err := WriteArbo(r.Childs[i], path+"/"+childname); err != nil {
+				return err
+			}
 		}
-		return 0
+		return nil
 	} else {
 		s := WriteFile(r)
-		n := path + r.name
-		n = supp0(n)
-		err := os.WriteFile(n, s, 0666)
+		err := os.WriteFile(path, s, 0666)
 		if err != nil {
-			fmt.Println("absolument illogique")
-			panic(err)
+			return fmt.Errorf("%w : %w", ErrWrite, err) // e.g. a directory in the way of the file
 		}
-		return 0
+		return nil
 	}
 }
-func supp0(a string) string {
-	var j int
-	for i := len(a) - 1; i > -1; i-- {
-		if byte(a[i]) == 0 {
-			j = i
-
-		}
-	}
-	a = a[:j]
-	return a
+func validName(a string) bool {
+	return a != "" && a != "." && a != ".." && !strings.ContainsAny(a, "/\\\x00")
 }
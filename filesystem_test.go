@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestGroupDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 40; i++ {
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%02d", i)), []byte{byte(i)}, 0644)
+	}
+	tree, err := createTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := []int{16, 16, 8}
+	if len(tree.Childs) != len(sizes) {
+		t.Fatalf("%d entries instead of %d parts", len(tree.Childs), len(sizes))
+	}
+	for i, part := range tree.Childs {
+		if part.name != fmt.Sprintf("part%d", i+1) || !part.Directory || len(part.Childs) != sizes[i] {
+			t.Fatalf("part %d is %s, of %d entries", i+1, part.name, len(part.Childs))
+		}
+		for j, c := range part.Childs {
+			if c.name != fmt.Sprintf("f%02d", i*16+j) {
+				t.Fatalf("%s found in %s", c.name, part.name)
+			}
+		}
+	}
+	// 257 entries make 17 parts, grouped again into 2
+	var children []Node
+	for i := 0; i < 257; i++ {
+		c := createChunkNode([]byte{byte(i)}, 1)
+		c.name = fmt.Sprintf("c%d", i)
+		children = append(children, c)
+	}
+	top := groupDirectory(children)
+	if len(top.Childs) != 2 || len(top.Childs[0].Childs) != 16 || len(top.Childs[1].Childs) != 1 {
+		t.Fatal("17 parts not grouped by 16")
+	}
+	if last := top.Childs[1].Childs[0]; last.name != "part17" || len(last.Childs) != 1 || last.Childs[0].name != "c256" {
+		t.Fatal("last entry misplaced")
+	}
+}
+
+func TestLongNames(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("é", 20) // 40 bytes
+	names := []string{long + "a", long + "b", "x" + long}
+	for _, name := range names {
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	tree, err := createTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, c := range tree.Childs {
+		if len(c.name) > 32 || !utf8.ValidString(c.name) || seen[c.name] {
+			t.Fatalf("entry shared as %q", c.name)
+		}
+		seen[c.name] = true
+	}
+	if len(seen) != len(names) {
+		t.Fatal("an entry is missing")
+	}
+}
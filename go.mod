@@ -0,0 +1,10 @@
+module projet_reseau_M2
+
+go 1.24.0
+
+require (
+	golang.org/x/crypto v0.45.0
+	golang.org/x/term v0.37.0
+)
+
+require golang.org/x/sys v0.38.0 // indirect
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	IDENTITIES
+*/
+
+/*
+	An identity is the name we register under and the key we sign with. The active identity is
+	used for every message we send : registerPeer and salute take it once, so that a handshake is
+	never half done under one name and half under another.
+	Named identities are kept in a keyring, key_dir/identities : <name>.pem holds the private
+	key, encrypted like privkey.pem (see keystore.go), <name>.pub.pem the public key in clear,
+	and the file active the name of the identity loaded at startup.
+*/
+
+type Identity struct {
+	Name string
+	Key  *ecdsa.PrivateKey // nil : our messages are not signed
+}
+
+/*
+	The active identity is read by the listener and the keepalive while the CLI swaps it : like
+	the shared tree (see sharing), it is published whole, and never modified once published.
+*/
+
+var identity atomic.Pointer[Identity]
+
+func activeIdentity() *Identity {
+	if id := identity.Load(); id != nil {
+		return id
+	}
+	return &Identity{Name: "NoName"}
+}
+
+func setIdentity(id *Identity) {
+	identity.Store(id)
+}
+
+func (id *Identity) PublicKey() []byte {
+	if id.Key == nil {
+		return nil
+	}
+	return pubkeyToByteSlice(computePubKey(id.Key))
+}
+
+func keyringDir() string {
+	return filepath.Join(key_dir, "identities")
+}
+
+func activeIdentityPath() string {
+	return filepath.Join(keyringDir(), "active")
+}
+
+/*
+	Names of identities and peers are used as file names : they cannot hold a path separator or
+	start with a dot.
+*/
+
+func validFileName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) || len(name) > 255 {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+func validIdentityName(name string) error {
+	if name == "active" || validFileName(name) != nil {
+		return fmt.Errorf("invalid identity name %q", name)
+	}
+	return nil
+}
+
+func identityPaths(name string) (string, string) {
+	return filepath.Join(keyringDir(), name+".pem"), filepath.Join(keyringDir(), name+".pub.pem")
+}
+
+/*
+	Creates a new identity with a fresh key, and saves it to the keyring.
+*/
+
+func createIdentity(name string, passphrase string) (*Identity, error) {
+	if err := validIdentityName(name); err != nil {
+		return nil, err
+	}
+	privpath, pubpath := identityPaths(name)
+	if _, err := os.Stat(privpath); err == nil {
+		return nil, fmt.Errorf("identity %s already exists", name)
+	}
+	id := &Identity{Name: name, Key: privKeyGen()}
+	if err := writeKeyPair(privpath, pubpath, id.Key, passphrase); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+/*
+	Reads an identity of the keyring, decrypting its key with passphrase.
+*/
+
+func loadNamedIdentity(name string, passphrase string) (*Identity, error) {
+	if err := validIdentityName(name); err != nil {
+		return nil, err
+	}
+	privpath, _ := identityPaths(name)
+	data, err := os.ReadFile(privpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no identity named %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := decryptKey(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s : %w", privpath, err)
+	}
+	return &Identity{Name: name, Key: key}, nil
+}
+
+/*
+	Makes id the active identity, and the one loaded at the next startup.
+*/
+
+func useIdentity(id *Identity) error {
+	setIdentity(id)
+	if err := os.MkdirAll(keyringDir(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(activeIdentityPath(), []byte(id.Name+"\n"), 0600)
+}
+
+func identityNames() ([]string, error) {
+	entries, err := os.ReadDir(keyringDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if n, found := strings.CutSuffix(e.Name(), ".pem"); found && !strings.HasSuffix(n, ".pub") {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func activeIdentityName() string {
+	data, err := os.ReadFile(activeIdentityPath())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func deleteIdentity(name string) error {
+	if err := validIdentityName(name); err != nil {
+		return err
+	}
+	if name == activeIdentityName() {
+		return fmt.Errorf("%s is the active identity : use another one first", name)
+	}
+	privpath, pubpath := identityPaths(name)
+	if err := os.Remove(privpath); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no identity named %s", name)
+	} else if err != nil {
+		return err
+	}
+	os.Remove(pubpath)
+	return nil
+}
+
+func printIdentities() {
+	names, err := identityNames()
+	if err != nil {
+		fmt.Println("Unable to read the keyring : ", err)
+		return
+	}
+	if len(names) == 0 {
+		fmt.Println("No identity in " + keyringDir() + " : use identity create [name].")
+		return
+	}
+	active := activeIdentityName()
+	for _, n := range names {
+		marker := " "
+		if n == active {
+			marker = "*"
+		}
+		key := "unknown public key"
+		_, pubpath := identityPaths(n)
+		if pub, err := readPublicKey(pubpath); err == nil {
+			key = hex.EncodeToString(pub)
+		}
+		fmt.Printf("%s %s : %s\n", marker, n, key)
+	}
+}
+
+/*
+	identity command : identity create|use|delete <name>, or identity list.
+*/
+
+func identityCommand(args []string) {
+	if len(args) == 0 || args[0] == "list" {
+		printIdentities()
+		return
+	}
+	if len(args) != 2 {
+		fmt.Println("Usage : identity create [name], identity use [name], identity delete [name], identity list")
+		return
+	}
+	switch args[0] {
+	case "create":
+		passphrase, err := askPassphrase("Passphrase of the new identity : ")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		id, err := createIdentity(args[1], passphrase)
+		if err == nil {
+			err = useIdentity(id)
+		}
+		if err != nil {
+			fmt.Println("Unable to create the identity : ", err)
+			return
+		}
+		fmt.Println("Now using " + id.Name + ", public key : " + hex.EncodeToString(id.PublicKey()))
+	case "use":
+		passphrase, err := askPassphrase("Passphrase of " + args[1] + " : ")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		id, err := loadNamedIdentity(args[1], passphrase)
+		if err == nil {
+			err = useIdentity(id)
+		}
+		if err != nil {
+			fmt.Println("Unable to use the identity : ", err)
+			return
+		}
+		fmt.Println("Now using " + id.Name + ".")
+		if serverConn() != nil {
+			fmt.Println("Register again for the server to know us under this name.")
+		}
+	case "delete":
+		if err := deleteIdentity(args[1]); err != nil {
+			fmt.Println("Unable to delete the identity : ", err)
+		}
+	default:
+		fmt.Println("Unknown identity command : " + args[0])
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	defer func(id *Identity) {
+		setIdentity(id)
+		os.RemoveAll(keyringDir())
+	}(activeIdentity())
+	alice, err := createIdentity("alice", "alice's passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createIdentity("alice", "another passphrase"); err == nil {
+		t.Fatal("alice created twice")
+	}
+	if _, err := createIdentity("bob", "bob's passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"active", "../alice", ".hidden", ""} {
+		if _, err := createIdentity(name, "passphrase"); err == nil {
+			t.Fatalf("identity %q created", name)
+		}
+	}
+	if err := useIdentity(alice); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := identityNames(); err != nil || !slices.Equal(names, []string{"alice", "bob"}) {
+		t.Fatal("keyring lists ", names, err)
+	}
+	if activeIdentityName() != "alice" || activeIdentity() != alice {
+		t.Fatal("alice is not the active identity")
+	}
+
+	loaded, err := loadNamedIdentity("alice", "alice's passphrase")
+	if err != nil || !loaded.Key.Equal(alice.Key) {
+		t.Fatal("alice not loaded back : ", err)
+	}
+	if _, err := loadNamedIdentity("alice", "bob's passphrase"); err == nil {
+		t.Fatal("alice loaded with a wrong passphrase")
+	}
+
+	if err := deleteIdentity("alice"); err == nil {
+		t.Fatal("the active identity was deleted")
+	}
+	if err := deleteIdentity("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteIdentity("bob"); err == nil {
+		t.Fatal("bob deleted twice")
+	}
+	if names, _ := identityNames(); !slices.Equal(names, []string{"alice"}) {
+		t.Fatal("keyring lists ", names, " after deleting bob")
+	}
+}
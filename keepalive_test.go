@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+/*
+	A peer answering every Hello, PublicKey and Root, which tells on types the requests it gets.
+*/
+
+func answeringPeer(t *testing.T) (net.Conn, chan byte) {
+	types := make(chan byte, 100)
+	conn := fakePeer(t, func(frame *Frame) marshaler {
+		select {
+		case types <- frame.Type:
+		default:
+		}
+		switch frame.Type {
+		case MSG_HELLO:
+			return &HelloMsg{Id: frame.Id, Type: MSG_HELLO_REPLY, Name: "ivan"}
+		case MSG_PUBLIC_KEY:
+			return &PublicKeyMsg{Id: frame.Id, Type: MSG_PUBLIC_KEY_REPLY}
+		case MSG_ROOT:
+			return &RootMsg{Id: frame.Id, Type: MSG_ROOT_REPLY, Hash: emptyStringHash}
+		}
+		return nil
+	})
+	return conn, types
+}
+
+func TestExpiredPeerIsSalutedAgain(t *testing.T) {
+	conn, types := answeringPeer(t)
+	peer := sessionOf(conn)
+	sessionsMutex.Lock()
+	peer.name = "ivan"
+	sessionsMutex.Unlock()
+	if err := salute(peer, activeIdentity()); err != nil {
+		t.Fatal(err)
+	}
+	for len(types) > 0 {
+		<-types
+	}
+	keepaliveRound(time.Now().Add(SESSION_EXPIRY + time.Second))
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msgtype := <-types:
+			if msgtype == MSG_PUBLIC_KEY { // a bare Hello would not send our key again
+				return
+			}
+		case <-timeout:
+			t.Fatal("the expired session was not saluted again")
+		}
+	}
+}
+
+func TestForgedDatagramsDoNotKeepAlive(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	s := getSession(addr.String())
+	sessionsMutex.Lock()
+	s.name = "judy"
+	s.pubkey = pubkeyToByteSlice(computePubKey(privKeyGen()))
+	s.hasKey = true
+	sessionsMutex.Unlock()
+	packet, _ := (&HelloMsg{Id: 1, Type: MSG_HELLO, Name: "judy"}).Marshal()
+	deliver(addr, packet) // unsigned
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if !s.lastSeen.IsZero() {
+		t.Fatal("an unsigned Hello kept the session of judy alive")
+	}
+}
+
+func TestIdleSessionsAreForgotten(t *testing.T) {
+	invalid := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10}
+	idle := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11}
+	deliver(invalid, []byte("garbage"))
+	packet, _ := (&Frame{Id: 1, Type: MSG_NOOP}).Marshal()
+	deliver(idle, packet)
+	sessionsMutex.Lock()
+	_, created := sessions[invalid.String()]
+	_, kept := sessions[idle.String()]
+	sessionsMutex.Unlock()
+	if created || !kept {
+		t.Fatal("sessions are made for invalid datagrams, or not for valid ones")
+	}
+	conn, _ := answeringPeer(t)
+	forgetStaleRequests(time.Now().Add(SESSION_EXPIRY + time.Second))
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if _, kept := sessions[idle.String()]; kept {
+		t.Fatal("the session of an idle address was kept")
+	}
+	if _, kept := sessions[conn.RemoteAddr().String()]; !kept {
+		t.Fatal("the session of a peer we dialed was forgotten")
+	}
+}
@@ -1,75 +1,87 @@
 package main
 
 import (
-	"encoding/binary"
-	"net"
+	"fmt"
+	"sync"
 	"time"
 )
 
-func keepalive(conn net.Conn, tree *Node) {
-	// TODO COPY PEER DATA IN MEMORY (NOTABLY THE KEYS)
-	for {
-		time.Sleep(time.Minute)
-		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-		tmp := readMsgNoSignature(conn)
-		if len(tmp) != 0 {
-			//on verifie uniquement les demande
-			//les reponse c'est pas notre probleme et ca veut dire que le message a été envoyé au mauvais endroit
-			if tmp[4] == byte(5) {
-				//respond a datum
-				n := findNode(tmp[7:39], *tree)
-				if n != nil || force_err {
-					if n.Directory {
-						buf := make([]byte, n.nbchild*32)
-						for i := 0; i < n.nbchild; i++ {
-							tmpname := []byte(n.Childs[i].name)
-							for j := 0; j < 32; j++ {
-								if j < 16 {
-									buf[i*32+j] = tmpname[j]
-								} else {
-									buf[i*32+j] = n.Childs[i].Hash[j]
-								}
-							}
-						}
-					} else if n.Big {
-						buf := make([]byte, n.nbchild*32)
-						for i := 0; i < n.nbchild; i++ {
-							for j := 0; j < 32; j++ {
-								buf[i*32+j] = n.Childs[i].Hash[j]
-							}
-						}
-						buildDatumReply(tmp[0:4], buf, tmp[7:39])
-					} else {
-						buildDatumReply(tmp[0:4], (*n).Data, tmp[7:39])
-					}
-				} else {
-					answer := make([]byte, 40)
-					for i := 0; i < 40; i++ {
-						answer[i] = tmp[i]
-					}
-					answer[5] = byte(133)
-					conn.Write(answer) // faire un renvoi de no datum
-				}
-			}
-			if tmp[4] == byte(2) {
-				hellorep := buildHelloReply(binary.BigEndian.Uint32(tmp[0:4]))
-				conn.Write(helloToByteSlice(hellorep))
+/*
+	KEEPALIVE
+*/
+
+/*
+	The REST server and peers forget a session after SESSION_EXPIRY without a message from us.
+	A single scheduler keeps every session we opened alive (the server and the connected peers) :
+	every KEEPALIVE_TICK, it sends a signed Hello to those we have not greeted for
+	KEEPALIVE_INTERVAL, well within the expiry window.
+	The scheduler never reads nor waits : the listener takes the HelloReply to its Hello (see
+	handleReply), and every datagram passing the signature policy updates the lastSeen of its
+	session. A session not heard from for SESSION_EXPIRY has expired on the other side too : its
+	handshake is reset. A peer is saluted again (see salute), in the background, so that it gets our
+	key and root again, through a NAT traversal if needed. For the server, the next Hello is a new
+	registration, whose PublicKey and Root requests are answered by the listener like any other
+	request.
+*/
+
+var KEEPALIVE_INTERVAL = 30 * time.Second
+var KEEPALIVE_TICK = 5 * time.Second
+var SESSION_EXPIRY = 180 * time.Second
+
+var keepaliveOnce sync.Once
+
+func startKeepalive() {
+	keepaliveOnce.Do(func() {
+		go func() {
+			for range time.Tick(KEEPALIVE_TICK) {
+				keepaliveRound(time.Now())
 			}
-			if tmp[4] == byte(3) {
-				rep := buildPubkeyReplyNoPubkey(binary.BigEndian.Uint32(tmp[0:4]))
-				if hasPubKey {
-					rep = buildPubkeyReplyWithPubkey(pubkey, binary.BigEndian.Uint32(tmp[0:4]))
+		}()
+	})
+}
+
+/*
+	Sessions to keep alive : those we dialed and did not close.
+*/
+
+func keptAlive() []*Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	var res []*Session
+	for _, s := range sessions {
+		if s.conn != nil {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func keepaliveRound(now time.Time) {
+	forgetStaleRequests(now)
+	id := activeIdentity()
+	for _, s := range keptAlive() {
+		sessionsMutex.Lock()
+		expired := s.helloDone && now.Sub(s.lastSeen) > SESSION_EXPIRY
+		if expired {
+			logProgress("Session with " + s.addr + " expired : greeting it again.")
+			s.helloDone = false
+			s.pubkeyDone = false
+			s.roothashDone = false
+		}
+		due := now.Sub(s.lastHello) >= KEEPALIVE_INTERVAL
+		conn := s.conn
+		name := s.name // empty for the server
+		sessionsMutex.Unlock()
+		if expired && name != "" {
+			go func() {
+				if err := salute(s, id); err != nil {
+					fmt.Println("Unable to reach "+name+" again : ", err)
 				}
-				conn.Write(requestToByteSlice(rep))
-			}
-		} else {
-			buf := make([]byte, 7)
-			for i := 0; i < 7; i++ {
-				buf[i] = byte(0)
-			}
-			conn.Write(buf) // mettre un noop a un moment plus logique
+			}()
+			continue
+		}
+		if due && conn != nil {
+			signAndWrite(conn, helloToByteSlice(buildHelloRequest(id.Name, s.newId(), 0)))
 		}
-		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-		readMsg(conn)
 	}
 }
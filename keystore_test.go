@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"testing"
+)
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	key := privKeyGen()
+	data, err := encryptKey(key, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block.Headers["KDF"] != "scrypt" {
+		t.Fatal("key sealed with ", block.Headers["KDF"])
+	}
+	got, err := decryptKey(data, "correct horse")
+	if err != nil || !got.Equal(key) {
+		t.Fatal("key not read back : ", err)
+	}
+	if _, err := decryptKey(data, "battery staple"); !errors.Is(err, ErrPassphrase) {
+		t.Fatal("wrong passphrase accepted : ", err)
+	}
+	block.Headers["N"] = "16384" // a weaker derivation than the one the key was sealed with
+	if _, err := decryptKey(pem.EncodeToMemory(block), "correct horse"); err == nil {
+		t.Fatal("tampered header accepted")
+	}
+	block.Headers["N"] = "1099511627776"
+	if _, err := decryptKey(pem.EncodeToMemory(block), "correct horse"); !errors.Is(err, ErrKeyFile) {
+		t.Fatal("unbounded scrypt cost accepted : ", err)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+/*
+	KNOWN PEERS
+*/
+
+/*
+	Like the known_hosts of SSH : the first key the REST server gives us for a peer is pinned in
+	key_dir/known_peers, one "name hexkey first-seen" line per peer, and later keys are checked
+	against it. When the key of a known peer changes, or disappears, we refuse to talk to it, or
+	only warn if key_changes is set to warn. The known command lists the pins, accepts the
+	current key of a peer, or revokes its pin. Names come from the network : one holding
+	whitespace or a control character would break the lines of the file, so it is never pinned.
+*/
+
+type knownPeer struct {
+	key       []byte
+	firstSeen time.Time
+}
+
+var known_peers map[string]knownPeer // nil until read from the file
+var knownPeersMutex sync.Mutex
+
+var refuse_key_changes = true // set from the key_changes setting : refuse, or only warn
+
+func knownPeersPath() string {
+	return filepath.Join(key_dir, "known_peers")
+}
+
+/*
+	Returns an error wrapping ErrBadName if name cannot be written on a line of the file.
+*/
+
+func checkPeerName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w : empty name", ErrBadName)
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("%w : %q", ErrBadName, name)
+		}
+	}
+	return nil
+}
+
+/*
+	Reads the known peers file, once. Must be called with knownPeersMutex held.
+*/
+
+func loadKnownPeers() error {
+	if known_peers != nil {
+		return nil
+	}
+	peers := make(map[string]knownPeer)
+	f, err := os.Open(knownPeersPath())
+	if errors.Is(err, os.ErrNotExist) {
+		known_peers = peers
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d : expected name, key and date", knownPeersPath(), lineno)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != 64 {
+			return fmt.Errorf("%s:%d : invalid key", knownPeersPath(), lineno)
+		}
+		seen, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			return fmt.Errorf("%s:%d : invalid date", knownPeersPath(), lineno)
+		}
+		peers[fields[0]] = knownPeer{key, seen}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	known_peers = peers
+	return nil
+}
+
+/*
+	Writes the known peers back, replacing the file at once. Must be called with knownPeersMutex held.
+*/
+
+func saveKnownPeers() error {
+	var names []string
+	for n := range known_peers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, n := range names {
+		p := known_peers[n]
+		fmt.Fprintf(&buf, "%s %s %s\n", n, hex.EncodeToString(p.key), p.firstSeen.UTC().Format(time.RFC3339))
+	}
+	if err := os.MkdirAll(key_dir, 0700); err != nil {
+		return err
+	}
+	tmp := knownPeersPath() + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, knownPeersPath())
+}
+
+/*
+	Checks the key the REST server gives for a peer against its pin, pinning it on first use.
+	Returns an error wrapping ErrKeyChanged if the key changed and changes are refused.
+	Names are not checked when key is empty, unless we pinned a key for them.
+*/
+
+func checkKnownPeer(name string, key []byte) error {
+	if err := checkPeerName(name); err != nil {
+		return err
+	}
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	if err := loadKnownPeers(); err != nil {
+		return fmt.Errorf("unable to read the known peers : %w", err)
+	}
+	pinned, known := known_peers[name]
+	if !known {
+		if len(key) == 0 {
+			return nil
+		}
+		known_peers[name] = knownPeer{append([]byte{}, key...), time.Now()}
+		fmt.Println("Trusting the key of " + name + " on first use : " + hex.EncodeToString(key))
+		if err := saveKnownPeers(); err != nil {
+			fmt.Println("Unable to save the known peers : ", err)
+		}
+		return nil
+	}
+	if bytes.Equal(pinned.key, key) {
+		return nil
+	}
+	got := "no key"
+	if len(key) != 0 {
+		got = "key " + hex.EncodeToString(key)
+	}
+	err := fmt.Errorf("%w : %s now has %s, we pinned %s on %s", ErrKeyChanged, name, got, hex.EncodeToString(pinned.key), pinned.firstSeen.Format(time.DateOnly))
+	if refuse_key_changes {
+		return err
+	}
+	fmt.Println("Warning : ", err)
+	return nil
+}
+
+/*
+	Returns the key to check the messages of name against : the one the REST server gives, once
+	checked against its pin, or the pinned one if the REST server cannot give it. A peer we cannot
+	get a key for, and never pinned, is refused with the error of the REST server.
+*/
+
+func peerKey(name string) ([]byte, error) {
+	if err := checkPeerName(name); err != nil {
+		return nil, err
+	}
+	key, err := fetchPubKey(name)
+	if err == nil {
+		return key, checkKnownPeer(name, key)
+	}
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	if loadKnownPeers() != nil {
+		return nil, err
+	}
+	pinned, known := known_peers[name]
+	if !known {
+		return nil, err
+	}
+	logProgress("Unable to fetch the key of " + name + ", using its pinned key : " + err.Error())
+	return pinned.key, nil
+}
+
+func printKnownPeers() {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	if err := loadKnownPeers(); err != nil {
+		fmt.Println("Unable to read the known peers : ", err)
+		return
+	}
+	if len(known_peers) == 0 {
+		fmt.Println("No known peer yet.")
+		return
+	}
+	var names []string
+	for n := range known_peers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		p := known_peers[n]
+		fmt.Printf("%s : %s, first seen %s\n", n, hex.EncodeToString(p.key), p.firstSeen.Format(time.DateTime))
+	}
+}
+
+/*
+	Pins key for name in place of the key seen before, or forgets name if key is empty.
+*/
+
+func setKnownPeer(name string, key []byte) error {
+	if err := checkPeerName(name); err != nil {
+		return err
+	}
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+	if err := loadKnownPeers(); err != nil {
+		return err
+	}
+	if _, known := known_peers[name]; !known && len(key) == 0 {
+		return fmt.Errorf("%s is not a known peer", name)
+	}
+	if len(key) == 0 {
+		delete(known_peers, name)
+	} else {
+		known_peers[name] = knownPeer{append([]byte{}, key...), time.Now()}
+	}
+	return saveKnownPeers()
+}
+
+/*
+	known command : known alone lists the pinned keys, known accept <name> pins the key the REST
+	server now gives for name, known revoke <name> forgets the pin, so that the next key is trusted.
+*/
+
+func knownCommand(args []string) {
+	if len(args) == 0 || args[0] == "list" {
+		printKnownPeers()
+		return
+	}
+	if len(args) != 2 {
+		fmt.Println("Usage : known [list], known accept [name], known revoke [name]")
+		return
+	}
+	switch args[0] {
+	case "accept":
+		key, err := fetchPubKey(args[1])
+		if err != nil {
+			fmt.Println("Unable to fetch the key of this peer : ", err)
+			return
+		}
+		if len(key) == 0 {
+			fmt.Println(args[1] + " publishes no key : use known revoke to forget its pin.")
+			return
+		}
+		if err := setKnownPeer(args[1], key); err != nil {
+			fmt.Println("Unable to pin this key : ", err)
+			return
+		}
+		fmt.Println("Now trusting the key of " + args[1] + " : " + hex.EncodeToString(key))
+	case "revoke":
+		if err := setKnownPeer(args[1], nil); err != nil {
+			fmt.Println("Unable to revoke this key : ", err)
+		}
+	default:
+		fmt.Println("Unknown known command : " + args[0])
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+/*
+	When the REST server gives no key for a peer, its pinned key is used, and a peer never pinned
+	is refused.
+*/
+
+func TestPeerKeyFallsBackToPin(t *testing.T) {
+	key := pubkeyToByteSlice(computePubKey(privKeyGen()))
+	if err := setKnownPeer("frank", key); err != nil {
+		t.Fatal(err)
+	}
+	defer setKnownPeer("frank", nil)
+	got, err := peerKey("frank")
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatal("pinned key not used : ", err)
+	}
+	if _, err := peerKey("grace"); err == nil {
+		t.Fatal("a peer without a key was accepted")
+	}
+}
+
+/*
+	A name from the network must neither pin another peer to its key, nor corrupt the file.
+*/
+
+func TestForgedNamesAreNotPinned(t *testing.T) {
+	alice := pubkeyToByteSlice(computePubKey(privKeyGen()))
+	if err := setKnownPeer("alice", alice); err != nil {
+		t.Fatal(err)
+	}
+	defer setKnownPeer("alice", nil)
+	mallory := hex.EncodeToString(pubkeyToByteSlice(computePubKey(privKeyGen())))
+	for _, name := range []string{"zz\nalice " + mallory + " 2030-01-01T00:00:00Z", "mallory smith", "eve\x00"} {
+		if err := checkKnownPeer(name, alice); !errors.Is(err, ErrBadName) {
+			t.Fatalf("%q pinned : %v", name, err)
+		}
+	}
+	knownPeersMutex.Lock()
+	known_peers = nil // read the file again, as after a restart
+	knownPeersMutex.Unlock()
+	if err := checkKnownPeer("alice", alice); err != nil {
+		t.Fatal("alice lost her pin : ", err)
+	}
+}
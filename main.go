@@ -1,68 +1,110 @@
 package main
 
 import (
-	"bufio"
-	"crypto/ecdsa"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 )
 
 /*
 GLOBAL VARS
 */
 
-var helloExchangeDone = false
-var pubkeyExchangeDone = false
-var roothashExchangeDone = false
-
-var hasPubKey = false
-var hasFiles = false
-
-var pubkey = make([]byte, 64)
-var privkey *ecdsa.PrivateKey
-var roothash = make([]byte, 32)
-
 var emptyStringHash = sha256.New().Sum(nil)
-var serv_addr = "jch.irif.fr:8443"
+var serv_addr = "jch.irif.fr:8443" // these are set from the configuration, see config.go
 var serv_addr_noport = "jch.irif.fr"
 var serv_url = "https://jch.irif.fr:8443"
+var serv_name = "jch.irif.fr" // name under which the server publishes its key
+var serv_key []byte           // key of the server, from the configuration or fetched at registration
+var listen_addr = ":0"        // any free port : peers learn it from the REST server
 
-var currentAbr = createNode("data_test.txt")
-
-var currentP2PConn net.Conn
-var connectedToPeer = false
-
-var servconn net.Conn // REST server connection
-var list net.Conn
-
-var peerpubkey = make([]byte, 64)
-var peerHasKey = false
-
-var peerroothash = make([]byte, 64)
-var peerHasFiles = false
+var currentPeer *Session // the peer we are connected to, nil if none
 
-var issuedTraversal = false
+var servconn net.Conn     // REST server connection, nil until registered : see serverConn
+var listener *net.UDPConn // passive UDP socket, shared by every exchange
+var servconnMutex sync.Mutex
 
 var debugmode = false
-var force_err = false  // this forces error-handling routines to happen, even if nothing failed
 var reqdisplay = false // display detailed content for sent requests
 var repdisplay = false // display detailed content for received replies
 
 var client *http.Client
 
-var name = "NoName"
+/*
+	The tree we export and its root hash. share builds a new tree while the listener serves the
+	current one : a tree is published as a whole, and never modified once published, so that a
+	reader always sees a tree together with its own hash.
+*/
+
+type sharedTree struct {
+	root     Node
+	hash     []byte
+	hasFiles bool // false until the share command
+}
+
+var shared atomic.Pointer[sharedTree]
+
+func sharing() *sharedTree {
+	if tree := shared.Load(); tree != nil {
+		return tree
+	}
+	return &sharedTree{root: createDirectoryNode(""), hash: make([]byte, 32)}
+}
+
+func publishTree(root Node) {
+	shared.Store(&sharedTree{root: root, hash: root.Hash, hasFiles: true})
+}
+
+/*
+	The connection to the REST server is replaced by the register command, while the listener
+	and the keepalive read it.
+*/
+
+func serverConn() net.Conn {
+	servconnMutex.Lock()
+	defer servconnMutex.Unlock()
+	return servconn
+}
+
+func setServerConn(conn net.Conn) {
+	servconnMutex.Lock()
+	defer servconnMutex.Unlock()
+	servconn = conn
+}
 
 func displayError(packet []byte) {
-	if (debugmode && len(packet) >= 5 && (packet[4] == 128 || packet[4] == 1)) || force_err {
-		fmt.Println("Error / ErrorReply from server : " + string(packet[7:]))
+	errmsg := &ErrorMsg{}
+	if debugmode && errmsg.Unmarshal(packet) == nil {
+		fmt.Println("Error / ErrorReply from server : " + errmsg.Message)
+	}
+}
+
+/*
+	Tells the user why a download failed, and what can be done about it.
+*/
+
+func downloadFailed(err error) {
+	fmt.Println("Erreur lors du download : ", err)
+	switch {
+	case errors.Is(err, ErrNoDatum):
+		fmt.Println("The peer does not have the whole tree : try swarm with other peers sharing it.")
+	case errors.Is(err, ErrRejected):
+		fmt.Println("The peer refused our requests : connect to it again, it may have forgotten us.")
+	case errors.Is(err, ErrTimeout):
+		fmt.Println("The peer stopped answering : what was received is cached, download again to resume.")
+	case errors.Is(err, ErrHashMismatch), errors.Is(err, ErrProtocol):
+		fmt.Println("The peer sent invalid data : nothing was written.")
+	case errors.Is(err, ErrWrite):
+		fmt.Println("The tree was received and is cached : move away what is in the way, then download again.")
 	}
 }
 
@@ -76,60 +118,115 @@ func logProgress(msg string) {
 REST register module
 */
 
-func registerPeer(name string, pubkey []byte, roothash []byte) {
-	// dial server
-	req := buildHelloRequest(name, 23, 0)
-	s := helloToByteSlice(req)
-	signAndWrite(servconn, s)
-	logProgress("Handshake initiated")
-	readMsg(servconn)
-	servconn.SetReadDeadline(time.Now().Add(time.Second * 5))
-	readMsg(servconn) // let the server speak first
-	if !pubkeyExchangeDone {
-		req2 := buildPubkeyRequestNoPubkey(91)
-		if hasPubKey {
-			req2 = buildPubkeyRequestWithPubkey(91, pubkey)
+/*
+	Pins the key of the REST server in its session : the key of the configuration, or else the one
+	it publishes under serv_name. Once pinned, every reply of the server must be signed with it.
+	A server that publishes no key cannot be authenticated, and is only trusted with a warning.
+*/
+
+func pinServerKey(server *Session) error {
+	key := serv_key
+	if len(key) == 0 {
+		var err error
+		key, err = fetchPubKey(serv_name)
+		if err != nil {
+			return fmt.Errorf("unable to fetch the key of the server : %w", err)
+		}
+		if err := checkKnownPeer(serv_name, key); err != nil {
+			return err
 		}
-		signAndWrite(servconn, requestToByteSlice(req2))
 	}
-	servconn.SetReadDeadline(time.Now().Add(time.Second * 5))
-	readMsg(servconn) // again
-	if !roothashExchangeDone {
-		req3 := buildRootRequestNoData(157)
-		if hasFiles {
-			req3 = buildRootRequest(157, roothash)
+	if len(key) == 0 {
+		fmt.Println("Warning : the server publishes no key, its replies cannot be authenticated.")
+		return nil
+	}
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	server.pubkey = key
+	server.hasKey = true
+	server.signedReplies = true
+	server.badSignature = nil
+	logProgress("Pinned the key of the server : " + hex.EncodeToString(key))
+	return nil
+}
+
+func registerPeer(id *Identity) error {
+	servconn := serverConn()
+	if servconn == nil {
+		return fmt.Errorf("not connected to the server")
+	}
+	server := sessionOf(servconn)
+	logProgress("Handshake initiated")
+	if _, err := request(id, servconn, helloToByteSlice(buildHelloRequest(id.Name, server.newId(), 0))); err != nil {
+		if errors.Is(err, ErrTimeout) && server.badSignature != nil {
+			return fmt.Errorf("the server at %s may be impersonated : %w", server.addr, server.badSignature)
 		}
-		signAndWrite(servconn, requestToByteSlice(req3))
+		return err
+	}
+	// the server asks for our key and root meanwhile : the listener answers it
+	keyId := server.newId()
+	req2 := buildPubkeyRequestNoPubkey(keyId)
+	if id.Key != nil {
+		req2 = buildPubkeyRequestWithPubkey(keyId, id.PublicKey())
+	}
+	if _, err := request(id, servconn, requestToByteSlice(req2)); err != nil {
+		return err
+	}
+	rootId := server.newId()
+	req3 := buildRootRequestNoData(rootId)
+	if tree := sharing(); tree.hasFiles {
+		req3 = buildRootRequest(rootId, tree.hash)
+	}
+	if _, err := request(id, servconn, requestToByteSlice(req3)); err != nil {
+		return err
 	}
-	readMsg(servconn) // and again
 	logProgress("Handshake successful.")
-	return
+	return nil
+}
+
+/*
+	Tells the REST server about our new root hash, once we are registered.
+*/
+
+func announceRoot() {
+	servconn := serverConn()
+	if servconn == nil {
+		logProgress("Not registered yet : the new root will be sent upon registration.")
+		return
+	}
+	req := buildRootRequest(sessionOf(servconn).newId(), sharing().hash)
+	if _, err := request(activeIdentity(), servconn, requestToByteSlice(req)); err != nil {
+		fmt.Println("Unable to announce the new root : ", err)
+		return
+	}
+	logProgress("New root announced to the server.")
 }
 
 func main() { // CLI Merge from REST and P2P (UDP)
-	transport := &*http.DefaultTransport.(*http.Transport)
-	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	client = &http.Client{
-		Transport: transport,
-		Timeout:   50 * time.Second,
+	if len(os.Args) > 1 && os.Args[1] == "serve-rendezvous" {
+		serveRendezvous(os.Args[2:])
+		return
 	}
-	// THIS BLOCK IS ONLY USEFUL FOR NAT TRAVERSAL REQUESTS
-	/* conn, _ = net.Dial("udp", serv_addr)
-	req := buildHelloRequest(name, 0, 0)
-	conn.Write(helloToByteSlice(req))
-	conn.SetReadDeadline(time.Now().Add(time.Second * 5)) // accept a delay for pubkey or roothash
-	readMsg(conn)                                         // TODO signature mode. We read all the replys and process them, until an empty message tells us we're done.
-	//go keepaliveNoSignature(conn) */
+	config, err := loadConfig(os.Args[1:])
+	if err == nil {
+		err = config.apply()
+	}
+	if err != nil {
+		fmt.Println("Invalid configuration : ", err)
+		os.Exit(2)
+	}
+	startListener(listen_addr)
+	startKeepalive()
+	loadIdentity()
 	listPeersFlag := false
 	helpFlag := false
 	exitFlag := false
-	reader := bufio.NewReader(os.Stdin)
 	for {
 		commandWord := ""
 		secondWord := ""
 		fmt.Print(">")
-		line, err := reader.ReadString('\n')
-		if err != nil || force_err {
+		line, err := stdin.ReadString('\n')
+		if err != nil {
 			log.Fatal(err)
 		}
 		line = strings.ReplaceAll(line, "\n", "") // remove trailing newline
@@ -144,6 +241,9 @@ func main() { // CLI Merge from REST and P2P (UDP)
 		helpFlag = false
 		// read user input
 		switch commandWord {
+		case "clearCache":
+			clearCache()
+			break
 		case "debugon":
 			debugmode = true
 			break
@@ -151,93 +251,215 @@ func main() { // CLI Merge from REST and P2P (UDP)
 			debugmode = false
 			break
 		case "exportKey":
-			exportKey()
+			passphrase, err := askPassphrase("Passphrase : ")
+			if err == nil {
+				err = exportKey(passphrase)
+			}
+			if err != nil {
+				fmt.Println("Unable to export our key : ", err)
+				break
+			}
+			fmt.Println("Key exported to " + privkeyPath())
 			break
-		case "forceerron":
-			force_err = true
+		case "fault":
+			faultCommand(parts[1:])
 			break
-		case "forceerroff":
-			force_err = false
+		case "signatures":
+			signaturesCommand(parts[1:])
 			break
 		case "list":
 			listPeersFlag = true
 			break
 		case "generateKey":
-			privkey = privKeyGen()
-			pubkey = pubkeyToByteSlice(computePubKey(privkey))
-			hasPubKey = true
-			logProgress("Public key : " + string(hex.EncodeToString(pubkey)))
+			setIdentity(&Identity{Name: activeIdentity().Name, Key: privKeyGen()})
+			logProgress("Public key : " + string(hex.EncodeToString(activeIdentity().PublicKey())))
 			break
 		case "importKey":
-			importKey()
-			fmt.Println("Imported key : " + string(hex.EncodeToString(pubkey)))
+			passphrase, err := askPassphrase("Passphrase of " + privkeyPath() + " : ")
+			if err == nil {
+				err = importKey(passphrase)
+			}
+			if err != nil {
+				fmt.Println("Unable to import our key : ", err)
+				break
+			}
+			fmt.Println("Imported key : " + string(hex.EncodeToString(activeIdentity().PublicKey())))
 			break
 		case "register":
-			helloExchangeDone = false
-			pubkeyExchangeDone = false
-			roothashExchangeDone = false
-			servconn, _ = net.Dial("udp", serv_addr)
-			//peerpubkey, peerHasKey = fetchPubKey(serv_addr_noport)
-			//Uncomment above when the REST Server will sign its HelloReply properly
-			registerPeer(name, pubkey, roothash)
-			go keepalive(servconn, &currentAbr)
+			conn, err := dialPeer(serv_addr)
+			setServerConn(conn) // nil if unreachable
+			if err != nil {
+				fmt.Println("Unable to reach the server : ", err)
+				break
+			}
+			err = pinServerKey(sessionOf(conn))
+			if err == nil {
+				err = registerPeer(activeIdentity())
+			}
+			if err != nil {
+				fmt.Println("Registration failed : ", err)
+				conn.Close()
+				setServerConn(nil)
+				break
+			}
+			break
+		case "share":
+			if secondWord == "" {
+				fmt.Println("Please provide the path of the file or directory to share.")
+				break
+			}
+			tree, err := createTree(secondWord)
+			if err != nil {
+				fmt.Println("Unable to share this path : ", err)
+				break
+			}
+			publishTree(tree)
+			fmt.Println("Now sharing " + secondWord + ", root hash : " + hex.EncodeToString(tree.Hash))
+			announceRoot()
+			break
+		case "setWindow":
+			w, err := strconv.Atoi(secondWord)
+			if err != nil || w < 1 {
+				fmt.Println("Please provide a positive amount of requests.")
+				break
+			}
+			downloadWindow = w
 			break
 		case "setName":
-			name = secondWord
+			setIdentity(&Identity{Name: secondWord, Key: activeIdentity().Key})
+			break
+		case "known":
+			knownCommand(parts[1:])
+			break
+		case "history":
+			historyCommand(parts[1:])
+			break
+		case "identity":
+			identityCommand(parts[1:])
 			break
 		case "exit":
 			exitFlag = true
 			break
 		case "connect":
-			if connectedToPeer {
-				fmt.Println("Already connected to someone : please disconnect beforehand.")
+			if peer := findPeer(secondWord); peer != nil {
+				currentPeer = peer
+				fmt.Println("Already connected to " + secondWord + " : now using it.")
 				break
 			}
-			helloExchangeDone = false
-			pubkeyExchangeDone = false
-			roothashExchangeDone = false
-			peer_addr, peer_exists := fetchAddress(secondWord)
-			if !peer_exists {
+			peer_addr, err := fetchAddress(secondWord)
+			if errors.Is(err, ErrNotFound) {
 				fmt.Println("Unable to find an address for this peer.")
 				break
 			}
-			currentP2PConn, err = net.Dial("udp", string(peer_addr))
-			if err != nil || force_err {
-				fmt.Println("Error connecting to the peer.")
-				if debugmode {
-					log.Fatal(err)
+			if err != nil {
+				fmt.Println("Unable to reach the REST server : ", err)
+				break
+			}
+			pubkey, err := peerKey(secondWord)
+			if err != nil {
+				fmt.Println("Refusing to connect : ", err)
+				if errors.Is(err, ErrKeyChanged) {
+					fmt.Println("If this change is expected, run known accept " + secondWord + ".")
 				}
+				break
+			}
+			roothash, err := fetchRootHash(secondWord)
+			if err != nil {
+				fmt.Println("Unable to fetch the root hash of this peer : ", err)
+			}
+			recordRoot(secondWord, roothash, nil)
+			conn, err := dialPeer(string(peer_addr))
+			if err != nil {
+				fmt.Println("Error connecting to the peer : ", err)
 			} else {
-				peerpubkey, peerHasKey = fetchPubKey(secondWord)
-				peerroothash, peerHasFiles = fetchRootHash(secondWord)
-				// Uncomment above when we figure out signatures
-				salute(name)
-				connectedToPeer = true
+				peer := sessionOf(conn)
+				sessionsMutex.Lock() // the listener already delivers the datagrams of the peer to its session
+				peer.name = secondWord
+				peer.pubkey = pubkey
+				peer.hasKey = len(pubkey) == 64
+				peer.roothash = roothash
+				peer.hasFiles = len(roothash) == 32
+				sessionsMutex.Unlock()
+				if err := salute(peer, activeIdentity()); err != nil {
+					fmt.Println("Unable to reach the peer : ", err)
+					disconnectPeer(peer)
+					break
+				}
+				currentPeer = peer // the keepalive takes over once connected
 				fmt.Println("Successfully connected to peer.")
 			}
-			// TODO maintain connection
 			break
 		case "disconnect":
-			if connectedToPeer {
-				currentP2PConn.Close()
-				helloExchangeDone = false
-				pubkeyExchangeDone = false
-				roothashExchangeDone = false
-				connectedToPeer = false
+			peer := currentPeer
+			if secondWord != "" {
+				peer = findPeer(secondWord)
+			}
+			if peer == nil {
+				fmt.Println("Not connected to this peer.")
+				break
 			}
+			disconnectPeer(peer)
+			break
+		case "peers":
+			printPeers()
+			break
+		case "requests":
+			printRequests()
+			break
+		case "use":
+			peer := findPeer(secondWord)
+			if peer == nil {
+				fmt.Println("Not connected to this peer : use connect first.")
+				break
+			}
+			currentPeer = peer
 			break
 		case "download":
-			if !connectedToPeer {
+			if currentPeer == nil {
 				fmt.Println("We're not currently connected to a peer !")
 			} else {
 				logProgress("on vas demander un download")
-				tmp, tmpe := downloadNode(peerroothash, currentP2PConn)
-				if tmpe != "SUCCESS" {
-					fmt.Printf("Erreur lors du download, %s\n", tmpe)
-				} else {
-					WriteArbo(tmp, "./testdump")
+				peer := currentPeer.snapshot()
+				if peer.conn == nil {
+					fmt.Println("We're not currently connected to a peer !")
+					break
+				}
+				tmp, tmpe := downloadNode(peer.roothash, peer.conn)
+				if tmpe == nil {
+					tmpe = WriteArbo(tmp, "./testdump")
 				}
+				if tmpe != nil {
+					downloadFailed(tmpe)
+				}
+			}
+		case "swarm":
+			hash := []byte{}
+			if currentPeer != nil {
+				hash = currentPeer.snapshot().roothash
+			}
+			if secondWord != "" {
+				hash, _ = hex.DecodeString(secondWord)
+			}
+			if len(hash) != 32 {
+				fmt.Println("Please provide a root hash, or use a peer sharing files.")
+				break
+			}
+			var conns []net.Conn
+			for _, peer := range livePeers() {
+				conns = append(conns, peer.conn)
 			}
+			if len(conns) == 0 {
+				fmt.Println("We're not currently connected to a peer !")
+				break
+			}
+			tmp, tmpe := downloadSwarm(hash, conns)
+			if tmpe == nil {
+				tmpe = WriteArbo(tmp, "./testdump")
+			}
+			if tmpe != nil {
+				downloadFailed(tmpe)
+			}
+			break
 		case "repon":
 			repdisplay = true
 			break
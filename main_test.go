@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+	Every test runs against the shared listener, as the client does, with the key directory and
+	the datum cache in a temporary directory instead of the working directory, and a rendezvous
+	server (testServer) instead of the course server. The listener reads the configuration
+	meanwhile : tests never change where the REST server is.
+*/
+
+var testServer *Rendezvous
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "p2p-test")
+	if err != nil {
+		panic(err)
+	}
+	key_dir = dir
+	cacheDir = filepath.Join(dir, "datumcache")
+	client = &http.Client{}
+	serv_name = "rendezvous"
+	natpeer := strings.Fields(os.Getenv(NAT_PEER_ENV))
+	if len(natpeer) == 3 { // the other client of TestNatTraversal, registering with its server
+		serv_addr, serv_url = natpeer[0], natpeer[1]
+	} else {
+		testServer, err = startRendezvous("127.0.0.1:0", "127.0.0.1:0", "", "")
+		if err != nil {
+			panic(err)
+		}
+		serv_addr, serv_url = testServer.UDPAddr(), testServer.URL()
+	}
+	startListener("127.0.0.1:0")
+	var code int
+	if len(natpeer) == 3 {
+		code = natPeer(natpeer[2])
+	} else {
+		code = m.Run()
+		testServer.Close()
+	}
+	listener.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+/*
+	A peer on a socket of its own, dialed by us : every datagram it gets is decoded and handed to
+	answer, whose reply, if not nil, is sent back.
+*/
+
+func fakePeer(t *testing.T, answer func(*Frame) marshaler) net.Conn {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, MAX_MESSAGE_SIZE)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			frame := &Frame{}
+			if frame.Unmarshal(append([]byte{}, buf[:n]...)) != nil {
+				continue
+			}
+			if rep := answer(frame); rep != nil {
+				packet, _ := rep.Marshal()
+				pc.WriteToUDP(packet, addr)
+			}
+		}
+	}()
+	conn, err := dialPeer(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { disconnectPeer(sessionOf(conn)) })
+	return conn
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+/*
+	The listener is shared by the whole process : the second client of a NAT traversal is this
+	test binary again, started with NAT_PEER_ENV set to the addresses of testServer and the name
+	to register under (see TestMain). It registers behind a simulated NAT, says ready, and serves
+	until its stdin closes. Each one has a name of its own, as the server keeps the previous ones
+	registered for a while.
+*/
+
+const NAT_PEER_ENV = "P2P_TEST_NAT_PEER"
+
+var natPeers = 0
+var natUs = &Identity{Name: "nat-us", Key: privKeyGen()} // the same key for every run of the test
+
+func natPeer(name string) int {
+	setIdentity(&Identity{Name: name, Key: privKeyGen()})
+	faults.mutex.Lock()
+	faults.nat = true
+	faults.mutex.Unlock()
+	conn, err := dialPeer(serv_addr)
+	if err == nil {
+		setServerConn(conn)
+		err = pinServerKey(sessionOf(conn))
+	}
+	if err == nil {
+		err = registerPeer(activeIdentity())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Registration failed : ", err)
+		return 1
+	}
+	fmt.Println("ready")
+	io.Copy(io.Discard, os.Stdin)
+	return 0
+}
+
+func startNatPeer(t *testing.T) string {
+	natPeers++
+	name := fmt.Sprintf("nat-peer-%d", natPeers)
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), NAT_PEER_ENV+"="+serv_addr+" "+serv_url+" "+name)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Wait()
+		setKnownPeer(name, nil)
+	})
+	lines := bufio.NewScanner(stdout)
+	for lines.Scan() {
+		if lines.Text() == "ready" {
+			go io.Copy(io.Discard, stdout)
+			return name
+		}
+	}
+	t.Fatal(name + " did not register")
+	return ""
+}
+
+func TestNatTraversal(t *testing.T) {
+	defer func(id *Identity, timeout, deadline time.Duration) {
+		setIdentity(id)
+		reply_timeout, request_deadline = timeout, deadline
+		faults.reset(0)
+	}(activeIdentity(), reply_timeout, request_deadline)
+	me := natUs
+	setIdentity(me)
+	reply_timeout = 100 * time.Millisecond
+	request_deadline = time.Second
+	name := startNatPeer(t)
+
+	faults.mutex.Lock()
+	faults.nat = true
+	faults.mutex.Unlock()
+	relay, err := dialPeer(serv_addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setServerConn(relay)
+	defer func() {
+		disconnectPeer(sessionOf(relay))
+		setServerConn(nil)
+	}()
+	if err := pinServerKey(sessionOf(relay)); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerPeer(me); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialPeer(addresses(t, testServer, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := sessionOf(conn)
+	defer disconnectPeer(peer)
+
+	_, err = request(me, conn, helloToByteSlice(buildHelloRequest(me.Name, peer.newId(), 0)))
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatal(name+" is not behind its NAT, our Hello got : ", err)
+	}
+	if err := salute(peer, me); err != nil {
+		t.Fatal("no NAT traversal : ", err)
+	}
+	server := sessionOf(relay)
+	sessionsMutex.Lock()
+	for id, p := range server.pending {
+		if p.msgtype == MSG_NAT_TRAVERSAL_REQUEST {
+			t.Error("NatTraversalRequest ", id, " still pending after the traversal")
+		}
+	}
+	sessionsMutex.Unlock()
+	if _, err := request(me, conn, helloToByteSlice(buildHelloRequest(me.Name, peer.newId(), 0))); err != nil {
+		t.Fatal("the NAT of "+name+" closed again : ", err)
+	}
+}
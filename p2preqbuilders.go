@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"net/netip"
 )
 
 /*
@@ -41,16 +42,17 @@ func buildHelloRequest(name string, id uint32, extensions uint32) *HelloExchange
 	}
 }
 
-func buildHelloReply(id uint32) *HelloExchange {
+func buildHelloReply(name string, id uint32) *HelloExchange {
 	bufid := make([]byte, 4)
 	binary.BigEndian.PutUint32(bufid, id)
 	buf := make([]byte, 2)
 	binary.BigEndian.PutUint16(buf, uint16(len(name)+4)) // +4 for extensions
 	return &HelloExchange{
-		Id:     bufid,
-		Type:   129,
-		Length: buf,
-		Name:   []byte(name),
+		Id:         bufid,
+		Type:       129,
+		Length:     buf,
+		Extensions: make([]byte, 4), // we do not support any extension
+		Name:       []byte(name),
 	}
 }
 
@@ -194,40 +196,20 @@ func buildDatumRequest(datahash []byte, id uint32) *P2PMsg { // 32 bytes long
 	}
 }
 
-func buildNatTraversalRequestIPv4(ipv4addr []byte, port uint16, id uint32) *P2PMsg {
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, uint16(6)) // ipv4 addr are on 4 bytes, +2 for port
-	buf2 := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf2, port)
-	buf3 := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf3, id)
-	return &P2PMsg{
-		Id:     buf3,
-		Type:   6,
-		Length: buf,
-		Body:   append(ipv4addr, buf2...),
-	}
-}
+/*
+	The socket address of a NAT traversal is encoded by NatTraversalMsg (see codec.go).
+*/
 
-func buildNatTraversalRequestIPv6(ipv6addr []byte, port uint16, id uint32) *P2PMsg {
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, uint16(18)) // ipv6 addr are on 16 bytes, +2 for port
-	buf2 := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf2, port)
-	buf3 := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf3, id)
-	return &P2PMsg{
-		Id:     buf3,
-		Type:   6,
-		Length: buf,
-		Body:   append(ipv6addr, buf2...),
+func buildNatTraversalRequest(addr netip.AddrPort, id uint32) *NatTraversalMsg {
+	return &NatTraversalMsg{
+		Id:   id,
+		Type: MSG_NAT_TRAVERSAL_REQUEST,
+		Addr: addr,
 	}
 }
 
 /*
-	UNUSED FUNCTIONS FOR NOW
-	(We do not currently store data and don't expect peers to contact us)
-	(We do not support NAT traversal for now)
+	Replies served by our passive listener
 */
 
 func buildDatumReply(id []byte, value []byte, hash []byte) *Datum { // variable length, assumed storable on 2 bytes
@@ -242,29 +224,15 @@ func buildDatumReply(id []byte, value []byte, hash []byte) *Datum { // variable
 	}
 }
 
-func buildNatTraversalReplyIPv4(ipv4addr []byte, port uint16) *P2PMsg {
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, uint16(6)) // ipv4 addr are on 4 bytes, +2 for port
-	buf2 := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf2, port)
-	return &P2PMsg{
-		Type:   7,
-		Length: buf,
-		Body:   append(ipv4addr, buf2...),
-	}
-}
-
-func buildNatTraversalReplyIPv6(ipv6addr []byte, port uint16, id uint32) *P2PMsg {
-	bufid := make([]byte, 4)
-	binary.BigEndian.PutUint32(bufid, id)
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, uint16(18)) // ipv6 addr are on 16 bytes, +2 for port
+func buildNoDatumReply(hash []byte, id uint32) *P2PMsg { // 32 bytes long
+	buf := make([]byte, 4)
 	buf2 := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf2, port)
+	binary.BigEndian.PutUint32(buf, id)
+	binary.BigEndian.PutUint16(buf2, uint16(32))
 	return &P2PMsg{
-		Id:     bufid,
-		Type:   7,
-		Length: buf,
-		Body:   append(ipv6addr, buf2...),
+		Id:     buf,
+		Type:   133,
+		Length: buf2,
+		Body:   hash,
 	}
 }
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	LOCAL RENDEZVOUS SERVER
+*/
+
+/*
+	A stand-in for the course server, so that the client can be run and tested offline.
+	It serves the same REST endpoints (/peers, /peers/{name}/addresses, /peers/{name}/key,
+	/peers/{name}/root, its own key being under RENDEZVOUS_NAME) and speaks the same UDP protocol : peers register with a Hello, the
+	server asks for their public key and root hash, and relays NAT traversal requests.
+	Once a peer published its key, its messages, and any Hello taking its name, must be signed
+	with this key.
+	It can be started from Go code with startRendezvous, or from the command line with
+	the serve-rendezvous subcommand.
+*/
+
+var REGISTRATION_EXPIRY = 180 * time.Second // a peer silent for this long is forgotten
+var RENDEZVOUS_NAME = "rendezvous"          // the server publishes its own key under this name
+
+type rendezvousPeer struct {
+	name     string
+	key      []byte // empty if the peer has no key
+	root     []byte // empty until the peer announces a root
+	lastSeen map[string]time.Time
+}
+
+type Rendezvous struct {
+	udp     *net.UDPConn
+	tcp     net.Listener
+	server  *http.Server
+	scheme  string
+	privkey *ecdsa.PrivateKey
+	peers   map[string]*rendezvousPeer // by name
+	byAddr  map[string]string          // name of the peer behind each UDP address
+	nextId  uint32
+	mutex   sync.Mutex
+}
+
+/*
+	Starts a rendezvous server : UDP registration on udpAddr, REST on httpAddr.
+	Plain HTTP is used unless a certificate and its key are given.
+*/
+
+func startRendezvous(udpAddr string, httpAddr string, certFile string, keyFile string) (*Rendezvous, error) {
+	laddr, err := net.ResolveUDPAddr("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rendezvous{
+		scheme:  "http",
+		privkey: privKeyGen(),
+		peers:   make(map[string]*rendezvousPeer),
+		byAddr:  make(map[string]string),
+	}
+	r.udp, err = net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	r.tcp, err = net.Listen("tcp", httpAddr)
+	if err != nil {
+		r.udp.Close()
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /peers", r.handlePeers)
+	mux.HandleFunc("GET /peers/{name}/addresses", r.handleAddresses)
+	mux.HandleFunc("GET /peers/{name}/key", r.handleKey)
+	mux.HandleFunc("GET /peers/{name}/root", r.handleRoot)
+	r.server = &http.Server{Handler: mux}
+	if certFile != "" {
+		r.scheme = "https"
+		go r.server.ServeTLS(r.tcp, certFile, keyFile)
+	} else {
+		go r.server.Serve(r.tcp)
+	}
+	go r.serveUDP()
+	return r, nil
+}
+
+func (r *Rendezvous) URL() string {
+	return r.scheme + "://" + r.tcp.Addr().String()
+}
+
+func (r *Rendezvous) UDPAddr() string {
+	return r.udp.LocalAddr().String()
+}
+
+func (r *Rendezvous) PublicKey() []byte {
+	return pubkeyToByteSlice(computePubKey(r.privkey))
+}
+
+func (r *Rendezvous) Close() {
+	r.server.Close()
+	r.udp.Close()
+}
+
+/*
+	Returns the peer registered under name, if one of its addresses is still alive.
+	Must be called with r.mutex held.
+*/
+
+func (r *Rendezvous) alive(name string) (*rendezvousPeer, bool) {
+	p, exists := r.peers[name]
+	if !exists {
+		return nil, false
+	}
+	for addr, seen := range p.lastSeen {
+		if time.Since(seen) > REGISTRATION_EXPIRY {
+			delete(p.lastSeen, addr)
+			delete(r.byAddr, addr)
+		}
+	}
+	if len(p.lastSeen) == 0 {
+		delete(r.peers, name)
+		return nil, false
+	}
+	return p, true
+}
+
+/*
+	REST endpoints
+*/
+
+func (r *Rendezvous) handlePeers(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var names []string
+	for name := range r.peers {
+		if _, ok := r.alive(name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+}
+
+func (r *Rendezvous) handleAddresses(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.alive(req.PathValue("name"))
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	var addrs []string
+	for addr := range p.lastSeen {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		fmt.Fprintln(w, addr)
+	}
+}
+
+func (r *Rendezvous) handleKey(w http.ResponseWriter, req *http.Request) {
+	if req.PathValue("name") == RENDEZVOUS_NAME {
+		w.Write(r.PublicKey())
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.alive(req.PathValue("name"))
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if len(p.key) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Write(p.key)
+}
+
+func (r *Rendezvous) handleRoot(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.alive(req.PathValue("name"))
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if len(p.root) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Write(p.root)
+}
+
+/*
+	UDP registration and NAT traversal relay
+*/
+
+func (r *Rendezvous) serveUDP() {
+	for {
+		buf := make([]byte, MAX_MESSAGE_SIZE)
+		n, addr, err := r.udp.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		r.handleDatagram(addr, buf[:n])
+	}
+}
+
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+func (r *Rendezvous) send(addr *net.UDPAddr, m marshaler) {
+	packet, err := m.Marshal()
+	if err != nil {
+		return
+	}
+	r.udp.WriteToUDP(signByteSlice(packet, r.privkey), addr)
+}
+
+func (r *Rendezvous) sendError(addr *net.UDPAddr, msgtype byte, msgid uint32, msg string) {
+	rep := &ErrorMsg{Id: msgid, Type: MSG_ERROR_REPLY, Message: msg}
+	if msgtype >= 128 {
+		rep.Type = MSG_ERROR
+	}
+	r.send(addr, rep)
+}
+
+func (r *Rendezvous) handleDatagram(addr *net.UDPAddr, packet []byte) {
+	frame := &Frame{}
+	if err := frame.Unmarshal(packet); err != nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	name, registered := r.byAddr[addr.String()]
+	var p *rendezvousPeer
+	if registered {
+		p, registered = r.alive(name)
+	}
+	if registered && len(p.key) == 64 && frame.Type != MSG_ERROR && frame.Type != MSG_ERROR_REPLY {
+		// once a peer published its key, its messages must be signed with it
+		if !verify(frame.Signed(), frame.Signature, byteSliceToPubkey(p.key)) {
+			r.sendError(addr, frame.Type, frame.Id, "Bad signature")
+			return
+		}
+	}
+	switch frame.Type {
+	case MSG_HELLO:
+		hello := &HelloMsg{}
+		if err := hello.Unmarshal(packet); err != nil || hello.Name == "" {
+			r.sendError(addr, frame.Type, frame.Id, "Invalid Hello")
+			return
+		}
+		if owner, taken := r.alive(hello.Name); taken && len(owner.key) == 64 && !verify(frame.Signed(), frame.Signature, byteSliceToPubkey(owner.key)) {
+			// a name whose owner published a key is only taken with a Hello signed by it
+			r.sendError(addr, frame.Type, frame.Id, "Bad signature")
+			return
+		}
+		if registered && p.name != hello.Name {
+			delete(p.lastSeen, addr.String())
+		}
+		p, exists := r.peers[hello.Name]
+		if !exists {
+			p = &rendezvousPeer{name: hello.Name, lastSeen: make(map[string]time.Time)}
+			r.peers[hello.Name] = p
+		}
+		p.lastSeen[addr.String()] = time.Now()
+		r.byAddr[addr.String()] = hello.Name
+		r.send(addr, &HelloMsg{Id: hello.Id, Type: MSG_HELLO_REPLY, Name: RENDEZVOUS_NAME})
+		if !registered {
+			// like the course server, ask a new peer for its key and root
+			r.nextId++
+			r.send(addr, &PublicKeyMsg{Id: r.nextId, Type: MSG_PUBLIC_KEY, Key: r.PublicKey()})
+			r.nextId++
+			r.send(addr, &RootMsg{Id: r.nextId, Type: MSG_ROOT, Hash: emptyStringHash})
+		}
+	case MSG_PUBLIC_KEY, MSG_PUBLIC_KEY_REPLY:
+		msg := &PublicKeyMsg{}
+		if err := msg.Unmarshal(packet); err != nil || !registered {
+			r.sendError(addr, frame.Type, frame.Id, "Please say hello first")
+			return
+		}
+		p.key = append([]byte{}, msg.Key...)
+		p.lastSeen[addr.String()] = time.Now()
+		if msg.Type == MSG_PUBLIC_KEY {
+			r.send(addr, &PublicKeyMsg{Id: msg.Id, Type: MSG_PUBLIC_KEY_REPLY, Key: r.PublicKey()})
+		}
+	case MSG_ROOT, MSG_ROOT_REPLY:
+		msg := &RootMsg{}
+		if err := msg.Unmarshal(packet); err != nil || !registered {
+			r.sendError(addr, frame.Type, frame.Id, "Please say hello first")
+			return
+		}
+		p.root = append([]byte{}, msg.Hash...)
+		p.lastSeen[addr.String()] = time.Now()
+		if msg.Type == MSG_ROOT {
+			r.send(addr, &RootMsg{Id: msg.Id, Type: MSG_ROOT_REPLY, Hash: emptyStringHash})
+		}
+	case MSG_NAT_TRAVERSAL_REQUEST:
+		msg := &NatTraversalMsg{}
+		if err := msg.Unmarshal(packet); err != nil || !registered {
+			r.sendError(addr, frame.Type, frame.Id, "Please say hello first")
+			return
+		}
+		// tell the target who wants to reach it, so that it opens its NAT towards them
+		from, _ := netip.ParseAddrPort(addr.String())
+		r.nextId++
+		target := net.UDPAddrFromAddrPort(msg.Addr)
+		r.send(target, &NatTraversalMsg{Id: r.nextId, Type: MSG_NAT_TRAVERSAL, Addr: from})
+	case MSG_NOOP, MSG_ERROR, MSG_ERROR_REPLY, MSG_HELLO_REPLY:
+		if registered {
+			p.lastSeen[addr.String()] = time.Now()
+		}
+	default:
+		r.sendError(addr, frame.Type, frame.Id, fmt.Sprintf("Unknown message type for type %d", frame.Type))
+	}
+}
+
+/*
+	serve-rendezvous subcommand
+*/
+
+func serveRendezvous(args []string) {
+	flags := flag.NewFlagSet("serve-rendezvous", flag.ExitOnError)
+	udpAddr := flags.String("udp", ":8443", "UDP address for registration and NAT traversal")
+	httpAddr := flags.String("http", ":8443", "TCP address of the REST endpoints")
+	certFile := flags.String("cert", "", "TLS certificate, plain HTTP if empty")
+	keyFile := flags.String("key", "", "TLS private key")
+	flags.Parse(args)
+	r, err := startRendezvous(*udpAddr, *httpAddr, *certFile, *keyFile)
+	if err != nil {
+		fmt.Println("Unable to start the rendezvous server : ", err)
+		return
+	}
+	fmt.Println("REST endpoints on " + r.URL() + ", UDP on " + r.UDPAddr())
+	fmt.Println("Public key : " + hex.EncodeToString(r.PublicKey()))
+	select {} // serve until killed
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+	A peer talking to the rendezvous server from a socket of its own, with our codec.
+*/
+
+type testPeer struct {
+	conn *net.UDPConn
+	key  *ecdsa.PrivateKey // nil for an unsigned peer
+}
+
+func dialTestPeer(t *testing.T, r *Rendezvous, key *ecdsa.PrivateKey) *testPeer {
+	raddr, err := net.ResolveUDPAddr("udp", r.UDPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testPeer{conn, key}
+}
+
+func (p *testPeer) send(t *testing.T, m marshaler) {
+	packet, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.key != nil {
+		packet = signByteSlice(packet, p.key)
+	}
+	p.conn.Write(packet)
+}
+
+/*
+	Answers the requests of the server until a reply of type msgtype comes, and returns it.
+*/
+
+func (p *testPeer) await(t *testing.T, msgtype byte) *Frame {
+	buf := make([]byte, MAX_MESSAGE_SIZE)
+	p.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no %s from the server : %v", msgTypeNames[msgtype], err)
+		}
+		frame := &Frame{}
+		if err := frame.Unmarshal(append([]byte{}, buf[:n]...)); err != nil {
+			t.Fatal(err)
+		}
+		switch frame.Type {
+		case msgtype:
+			return frame
+		case MSG_PUBLIC_KEY:
+			rep := &PublicKeyMsg{Id: frame.Id, Type: MSG_PUBLIC_KEY_REPLY}
+			if p.key != nil {
+				rep.Key = pubkeyToByteSlice(computePubKey(p.key))
+			}
+			p.send(t, rep)
+		case MSG_ROOT:
+			p.send(t, &RootMsg{Id: frame.Id, Type: MSG_ROOT_REPLY, Hash: emptyStringHash})
+		}
+	}
+}
+
+func (p *testPeer) hello(t *testing.T, name string, id uint32) {
+	p.send(t, &HelloMsg{Id: id, Type: MSG_HELLO, Name: name})
+}
+
+func addresses(t *testing.T, r *Rendezvous, name string) string {
+	resp, err := http.Get(r.URL() + "/peers/" + name + "/addresses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return strings.TrimSpace(string(body))
+}
+
+func TestRendezvousProtectsKeyedNames(t *testing.T) {
+	r, err := startRendezvous("127.0.0.1:0", "127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	alice := dialTestPeer(t, r, privKeyGen())
+	alice.hello(t, "alice", 1)
+	alice.await(t, MSG_HELLO_REPLY)
+	// the server asked for her key meanwhile : wait until it has it
+	alice.send(t, &RootMsg{Id: 2, Type: MSG_ROOT, Hash: emptyStringHash})
+	alice.await(t, MSG_ROOT_REPLY)
+
+	for _, mallory := range []*testPeer{dialTestPeer(t, r, nil), dialTestPeer(t, r, privKeyGen())} {
+		mallory.hello(t, "alice", 3)
+		rep := mallory.await(t, MSG_ERROR_REPLY)
+		if rep.Id != 3 {
+			t.Fatal("ErrorReply to another request : ", rep.Id)
+		}
+	}
+	if addrs := addresses(t, r, "alice"); addrs != alice.conn.LocalAddr().String() {
+		t.Fatal("alice was hijacked, her addresses are now ", addrs)
+	}
+
+	moved := dialTestPeer(t, r, alice.key) // alice again, from another address
+	moved.hello(t, "alice", 4)
+	moved.await(t, MSG_HELLO_REPLY)
+	if addrs := addresses(t, r, "alice"); !strings.Contains(addrs, moved.conn.LocalAddr().String()) {
+		t.Fatal("alice cannot register a new address : ", addrs)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+/*
+	RETRANSMISSION
+*/
+
+/*
+	UDP loses datagrams : every request we wait a reply for is sent again, with the same id, until
+	the reply comes or request_deadline passes. The first wait is reply_timeout, and every
+	retransmission doubles it, up to RETRY_MAX_DELAY. Each wait is spread by up to a quarter either
+	way (jitter), so that the clients that lost the same datagram do not all send again at once.
+	A reply carrying the id of the request, whatever the sending it answers, ends the wait : an
+	ErrorReply is a reply too, and is told apart from no reply at all (ErrRejected, ErrTimeout).
+	Every retransmission follows this retryPolicy :
+	- request, for the handshakes with the server and the peers (Hello, PublicKey, Root) ;
+	- traverseNat, whose NatTraversalRequest is answered by the Hello of the peer, not by the server ;
+	- the download engine, which keeps many GetDatum in flight at once instead of waiting for each
+	  one : its first wait is the round-trip time it measures, and a request is also given up after
+	  MAX_DATUM_RETRIES sendings (see retransmit in download.go).
+*/
+
+var RETRY_MAX_DELAY = 8 * time.Second
+var request_deadline = 10 * time.Second // how long a request is sent again, set from the configuration
+
+type retryPolicy struct {
+	first    time.Duration // wait after the first sending
+	max      time.Duration // longest wait
+	deadline time.Duration // how long after its first sending a request is given up
+	retries  int           // retransmissions before giving up, 0 for no limit
+}
+
+/*
+	Policy of the requests we wait a reply for, from the configuration.
+*/
+
+func requestPolicy() retryPolicy {
+	return retryPolicy{first: reply_timeout, max: RETRY_MAX_DELAY, deadline: request_deadline}
+}
+
+/*
+	Time to wait for a reply after the retries-th retransmission of a request (0 for the first
+	sending).
+*/
+
+func (p retryPolicy) wait(retries int) time.Duration {
+	t := p.first << retries
+	if t > p.max || t <= 0 {
+		t = p.max
+	}
+	return t - t/4 + time.Duration(rand.Int63n(int64(t/2)+1))
+}
+
+/*
+	Whether a request first sent at first, and sent again retries times, is to be given up.
+*/
+
+func (p retryPolicy) exhausted(first time.Time, retries int, now time.Time) bool {
+	return now.Sub(first) >= p.deadline || (p.retries > 0 && retries >= p.retries)
+}
+
+/*
+	Calls send, then again every time a wait passes without anything on done, with the amount of
+	retransmissions so far, until done gets something or the request is exhausted. Returns what
+	done got, the amount of sendings, and whether anything came.
+*/
+
+func (p retryPolicy) run(send func(retries int), done <-chan Reply) (Reply, int, bool) {
+	first := time.Now()
+	for retries := 0; ; retries++ {
+		send(retries)
+		wait := p.wait(retries)
+		if left := p.deadline - time.Since(first); wait > left {
+			wait = left
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case rep := <-done:
+			timer.Stop()
+			return rep, retries + 1, true
+		case <-timer.C:
+		}
+		if p.exhausted(first, retries, time.Now()) {
+			return Reply{}, retries + 1, false
+		}
+	}
+}
+
+/*
+	Sends a request on behalf of id, and sends it again until its reply comes or request_deadline
+	passes. Returns the reply ; an error wrapping ErrTimeout if none came, or a *RejectedError if
+	the reply is an ErrorReply.
+*/
+
+func request(id *Identity, conn net.Conn, content []byte) (Reply, error) {
+	if len(content) < HEADER_SIZE {
+		return Reply{}, fmt.Errorf("%w : unable to encode our request", ErrProtocol)
+	}
+	s := sessionOf(conn)
+	msgid := binary.BigEndian.Uint32(content[0:4])
+	msgtype := msgTypeNames[content[4]]
+	ch := make(chan Reply, 1)
+	s.await(msgid, ch)
+	defer s.abandon(msgid)
+	rep, sent, replied := requestPolicy().run(func(retries int) {
+		if retries > 0 {
+			logProgress(fmt.Sprintf("No reply to our %s %d from %s yet : sending it again.", msgtype, msgid, s.addr))
+		}
+		sendAs(id, conn, content)
+	}, ch)
+	if !replied {
+		return Reply{}, fmt.Errorf("%w : no reply to our %s from %s, sent %d times", ErrTimeout, msgtype, s.addr, sent)
+	}
+	if rep.Frame.Type == MSG_ERROR_REPLY {
+		return rep, &RejectedError{s.addr, msgtype, string(rep.Frame.Body)}
+	}
+	return rep, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := retryPolicy{first: time.Second, max: 8 * time.Second, deadline: 10 * time.Second, retries: 5}
+	for i := 0; i < 1000; i++ {
+		if d := p.wait(2); d < 3*time.Second || d > 5*time.Second {
+			t.Fatal("third wait of ", d)
+		}
+		if d := p.wait(40); d < 6*time.Second || d > 10*time.Second {
+			t.Fatal("wait of ", d, " over the maximum")
+		}
+	}
+	now := time.Now()
+	if p.exhausted(now, 4, now) || !p.exhausted(now, 5, now) || !p.exhausted(now.Add(-10*time.Second), 0, now) {
+		t.Fatal("the retries and the deadline are not both enforced")
+	}
+}
+
+/*
+	A peer answering only the third sending of a Hello, and an ErrorReply to a Root.
+*/
+
+func reluctantPeer(t *testing.T) net.Conn {
+	hellos := 0
+	return fakePeer(t, func(frame *Frame) marshaler {
+		switch frame.Type {
+		case MSG_HELLO:
+			if hellos++; hellos < 3 {
+				return nil
+			}
+			return &HelloMsg{Id: frame.Id, Type: MSG_HELLO_REPLY, Name: "kim"}
+		case MSG_ROOT:
+			return &ErrorMsg{Id: frame.Id, Type: MSG_ERROR_REPLY, Message: "go away"}
+		}
+		return nil
+	})
+}
+
+func TestRequestRetries(t *testing.T) {
+	defer func(timeout, deadline time.Duration) {
+		reply_timeout, request_deadline = timeout, deadline
+	}(reply_timeout, request_deadline)
+	reply_timeout = 50 * time.Millisecond
+	request_deadline = 2 * time.Second
+	conn := reluctantPeer(t)
+	s := sessionOf(conn)
+	me := activeIdentity()
+	rep, err := request(me, conn, helloToByteSlice(buildHelloRequest(me.Name, s.newId(), 0)))
+	if err != nil || rep.Frame.Type != MSG_HELLO_REPLY {
+		t.Fatal("no HelloReply to the third Hello : ", err)
+	}
+	_, err = request(me, conn, requestToByteSlice(buildRootRequestNoData(s.newId())))
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.Message != "go away" {
+		t.Fatal("ErrorReply not reported : ", err)
+	}
+	request_deadline = 300 * time.Millisecond
+	if _, err := request(me, conn, requestToByteSlice(buildPubkeyRequestNoPubkey(s.newId()))); !errors.Is(err, ErrTimeout) {
+		t.Fatal("no timeout without a reply : ", err)
+	}
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if len(s.pending) != 0 || len(s.waiting) != 0 {
+		t.Fatal("requests left pending after their reply or their deadline")
+	}
+}
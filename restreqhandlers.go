@@ -4,7 +4,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 )
@@ -15,8 +14,8 @@ import (
 
 func aux_list_printer(body io.ReadCloser) {
 	text, err := io.ReadAll(body)
-	if (err != nil && debugmode) || force_err {
-		log.Fatal("readResponseBody: ", err)
+	if err != nil {
+		fmt.Println("Unable to read the reply of the REST server : ", networkError(err))
 		return
 	}
 	for _, line := range strings.Split(string(text[:]), "\n") {
@@ -28,8 +27,8 @@ func aux_list_printer(body io.ReadCloser) {
 
 func aux_hash_printer(body io.ReadCloser) {
 	text, err := io.ReadAll(body)
-	if (err != nil && debugmode) || force_err {
-		log.Fatal("readResponseBody: ", err)
+	if err != nil {
+		fmt.Println("Unable to read the reply of the REST server : ", networkError(err))
 		return
 	}
 	hexHash := hex.EncodeToString(text)
@@ -70,3 +69,30 @@ func processGetPeerRootHashResponse(resp *http.Response) {
 	aux_hash_printer(resp.Body)
 	resp.Body.Close()
 }
+
+/*
+	Sends a request to the REST server and reads the whole reply.
+	200 and 204 are the expected statuses : a 404 gives ErrNotFound, anything else ErrServer.
+*/
+
+func restGet(req *http.Request, err error) ([]byte, int, error) {
+	if err != nil {
+		return nil, 0, &RESTError{serv_url, 0, fmt.Errorf("%w : invalid request : %w", ErrServer, err)}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, &RESTError{req.URL.String(), 0, networkError(err)}
+	}
+	defer resp.Body.Close()
+	text, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, &RESTError{req.URL.String(), resp.StatusCode, networkError(err)}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return text, resp.StatusCode, nil
+	case http.StatusNotFound:
+		return nil, resp.StatusCode, &RESTError{req.URL.String(), resp.StatusCode, ErrNotFound}
+	}
+	return nil, resp.StatusCode, &RESTError{req.URL.String(), resp.StatusCode, ErrServer}
+}
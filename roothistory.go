@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	ROOT HISTORY
+*/
+
+/*
+	Every root hash we learn for a named peer is kept in key_dir/roots/<name>, one line per change :
+	"time source hash id signature", where source is rest when the REST server gave it to us, or
+	root / rootreply for the message the peer sent it in, with the id of that message and its
+	signature (- if unsigned). A signed entry can thus be checked again later against the key of
+	the peer. A root is recorded when it differs from the last one, or comes signed when the
+	last one did not.
+	The history command lists the roots of a peer, and compares the trees of two of them.
+*/
+
+type rootEntry struct {
+	seen      time.Time
+	hash      []byte
+	source    string
+	id        uint32
+	signature []byte // nil if unsigned
+}
+
+var root_history = make(map[string][]rootEntry) // by peer name, read from the files on first use
+var rootHistoryMutex sync.Mutex
+
+func rootHistoryPath(name string) string {
+	return filepath.Join(key_dir, "roots", name)
+}
+
+func (r rootEntry) String() string {
+	sig := "-"
+	if r.signature != nil {
+		sig = hex.EncodeToString(r.signature)
+	}
+	return fmt.Sprintf("%s %s %s %d %s", r.seen.UTC().Format(time.RFC3339Nano), r.source, hex.EncodeToString(r.hash), r.id, sig)
+}
+
+func parseRootEntry(line string) (rootEntry, error) {
+	var r rootEntry
+	fields := strings.Fields(line)
+	if len(fields) != 5 {
+		return r, errors.New("expected time, source, hash, id and signature")
+	}
+	var err error
+	if r.seen, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+		return r, err
+	}
+	r.source = fields[1]
+	if r.hash, err = hex.DecodeString(fields[2]); err != nil || len(r.hash) != 32 {
+		return r, errors.New("invalid hash")
+	}
+	id, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return r, err
+	}
+	r.id = uint32(id)
+	if fields[4] != "-" {
+		if r.signature, err = hex.DecodeString(fields[4]); err != nil || len(r.signature) != SIGNATURE_SIZE {
+			return r, errors.New("invalid signature")
+		}
+	}
+	return r, nil
+}
+
+/*
+	Returns the history of a peer, reading it from its file the first time.
+	Must be called with rootHistoryMutex held.
+*/
+
+func lockedRootHistory(name string) ([]rootEntry, error) {
+	if entries, found := root_history[name]; found {
+		return entries, nil
+	}
+	f, err := os.Open(rootHistoryPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		root_history[name] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []rootEntry
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		r, err := parseRootEntry(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d : %w", rootHistoryPath(name), lineno, err)
+		}
+		entries = append(entries, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	root_history[name] = entries
+	return entries, nil
+}
+
+/*
+	Records a root hash of a peer : frame is the Root or RootReply that carried it, nil if it comes
+	from the REST server.
+*/
+
+func recordRoot(name string, hash []byte, frame *Frame) {
+	if validFileName(name) != nil || len(hash) != 32 {
+		return
+	}
+	r := rootEntry{seen: time.Now(), hash: append([]byte{}, hash...), source: "rest"}
+	if frame != nil {
+		r.source = msgTypeNames[frame.Type]
+		r.id = frame.Id
+		if len(frame.Signature) == SIGNATURE_SIZE {
+			r.signature = append([]byte{}, frame.Signature...)
+		}
+	}
+	rootHistoryMutex.Lock()
+	defer rootHistoryMutex.Unlock()
+	entries, err := lockedRootHistory(name)
+	if err != nil {
+		logProgress("Unable to read the root history : " + err.Error())
+		return
+	}
+	if n := len(entries); n > 0 && bytes.Equal(entries[n-1].hash, r.hash) && (entries[n-1].signature != nil || r.signature == nil) {
+		return // nothing new
+	}
+	root_history[name] = append(entries, r)
+	if err := os.MkdirAll(filepath.Dir(rootHistoryPath(name)), 0700); err != nil {
+		logProgress("Unable to save the root history : " + err.Error())
+		return
+	}
+	f, err := os.OpenFile(rootHistoryPath(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logProgress("Unable to save the root history : " + err.Error())
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, r)
+}
+
+/*
+	Checks the signature of an entry against key : the signed message is rebuilt from its id and type.
+*/
+
+func (r rootEntry) verifiedBy(key []byte) bool {
+	if r.signature == nil || len(key) != 64 {
+		return false
+	}
+	frame := &Frame{Id: r.id, Type: MSG_ROOT, Body: r.hash}
+	if r.source == msgTypeNames[MSG_ROOT_REPLY] {
+		frame.Type = MSG_ROOT_REPLY
+	}
+	return verify(frame.Signed(), r.signature, byteSliceToPubkey(key))
+}
+
+func printRootHistory(name string) {
+	rootHistoryMutex.Lock()
+	entries, err := lockedRootHistory(name)
+	rootHistoryMutex.Unlock()
+	if err != nil {
+		fmt.Println("Unable to read the root history : ", err)
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("No root seen for " + name + ".")
+		return
+	}
+	knownPeersMutex.Lock()
+	loadKnownPeers()
+	key := known_peers[name].key
+	knownPeersMutex.Unlock()
+	for i, r := range entries {
+		status := "unsigned"
+		if r.signature != nil {
+			status = "signature not checked, no pinned key"
+			if key != nil && r.verifiedBy(key) {
+				status = "signed by the pinned key"
+			} else if key != nil {
+				status = "NOT signed by the pinned key"
+			}
+		}
+		if r.source == "rest" {
+			status = "from the REST server"
+		}
+		fmt.Printf("%d : %s %s, via %s, %s\n", i, r.seen.Format(time.DateTime), hex.EncodeToString(r.hash), r.source, status)
+	}
+}
+
+/*
+	Lists the files of a tree, by path, with their hash.
+*/
+
+func flattenTree(n Node, path string, files map[string][]byte) {
+	if !n.Directory {
+		files[path] = n.Hash
+		return
+	}
+	for _, c := range n.Childs {
+		flattenTree(c, path+"/"+c.name, files)
+	}
+}
+
+/*
+	Returns the files of the tree rooted at hash, from the cache or from the peer if connected.
+*/
+
+func rootFiles(name string, hash []byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if bytes.Equal(hash, emptyStringHash) {
+		return files, nil // nothing shared
+	}
+	var conns []net.Conn
+	if peer := findPeer(name); peer != nil {
+		if conn := peer.snapshot().conn; conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	tree, err := downloadSwarm(hash, conns)
+	if err != nil {
+		return nil, err
+	}
+	flattenTree(tree, "", files)
+	return files, nil
+}
+
+/*
+	Lists the files added (+), removed (-) and modified (~) from before to after, by path.
+*/
+
+func fileChanges(before map[string][]byte, after map[string][]byte) []string {
+	var paths []string
+	for p := range before {
+		paths = append(paths, p)
+	}
+	for p := range after {
+		if _, found := before[p]; !found {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	var changes []string
+	for _, p := range paths {
+		old, inBefore := before[p]
+		cur, inAfter := after[p]
+		switch {
+		case !inBefore:
+			changes = append(changes, "+ "+p)
+		case !inAfter:
+			changes = append(changes, "- "+p)
+		case !bytes.Equal(old, cur):
+			changes = append(changes, "~ "+p)
+		}
+	}
+	return changes
+}
+
+/*
+	Prints the files changed between two roots of a peer.
+*/
+
+func diffRoots(name string, from int, to int) error {
+	rootHistoryMutex.Lock()
+	entries, err := lockedRootHistory(name)
+	rootHistoryMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if from < 0 || from >= len(entries) || to < 0 || to >= len(entries) {
+		return fmt.Errorf("%s has %d roots in its history", name, len(entries))
+	}
+	before, err := rootFiles(name, entries[from].hash)
+	if err != nil {
+		return fmt.Errorf("unable to fetch root %d : %w", from, err)
+	}
+	after, err := rootFiles(name, entries[to].hash)
+	if err != nil {
+		return fmt.Errorf("unable to fetch root %d : %w", to, err)
+	}
+	changes := fileChanges(before, after)
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if len(changes) == 0 {
+		fmt.Println("No difference.")
+	}
+	return nil
+}
+
+/*
+	history command : history [peer] lists the roots of a peer (the current one by default),
+	history [peer] diff [i] [j] compares two of them, the last one if j is not given.
+*/
+
+func historyCommand(args []string) {
+	name := ""
+	if len(args) > 0 && args[0] != "diff" {
+		name = args[0]
+		args = args[1:]
+	} else if currentPeer != nil {
+		name = currentPeer.snapshot().name
+	}
+	if name == "" {
+		fmt.Println("Please provide the name of a peer.")
+		return
+	}
+	if len(args) == 0 {
+		printRootHistory(name)
+		return
+	}
+	if args[0] != "diff" || len(args) < 2 || len(args) > 3 {
+		fmt.Println("Usage : history [peer], history [peer] diff [i] [j]")
+		return
+	}
+	from, err := strconv.Atoi(args[1])
+	if err != nil {
+		fmt.Println("Invalid root number : " + args[1])
+		return
+	}
+	rootHistoryMutex.Lock()
+	entries, _ := lockedRootHistory(name)
+	rootHistoryMutex.Unlock()
+	to := len(entries) - 1
+	if len(args) == 3 {
+		if to, err = strconv.Atoi(args[2]); err != nil {
+			fmt.Println("Invalid root number : " + args[2])
+			return
+		}
+	}
+	if err := diffRoots(name, from, to); err != nil {
+		fmt.Println("Unable to compare these roots : ", err)
+	}
+}
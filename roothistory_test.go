@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func forgetRoots(name string) {
+	rootHistoryMutex.Lock()
+	defer rootHistoryMutex.Unlock()
+	delete(root_history, name)
+	os.Remove(rootHistoryPath(name))
+}
+
+func rootsOf(t *testing.T, name string) []rootEntry {
+	rootHistoryMutex.Lock()
+	defer rootHistoryMutex.Unlock()
+	entries, err := lockedRootHistory(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestRecordRoot(t *testing.T) {
+	forgetRoots("olga")
+	defer forgetRoots("olga")
+	key := privKeyGen()
+	first, second := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	packet, _ := (&RootMsg{Id: 5, Type: MSG_ROOT_REPLY, Hash: first}).Marshal()
+	signed := &Frame{}
+	if err := signed.Unmarshal(signByteSlice(packet, key)); err != nil {
+		t.Fatal(err)
+	}
+
+	recordRoot("olga", first, nil)
+	recordRoot("olga", first, nil)
+	if n := len(rootsOf(t, "olga")); n != 1 {
+		t.Fatal("the same root recorded ", n, " times")
+	}
+	recordRoot("olga", first, signed)
+	recordRoot("olga", first, signed)
+	recordRoot("olga", first, nil)
+	if n := len(rootsOf(t, "olga")); n != 2 {
+		t.Fatal("the root signed by olga recorded ", n-1, " times")
+	}
+	recordRoot("olga", second, nil)
+
+	rootHistoryMutex.Lock()
+	delete(root_history, "olga") // read the file again, as after a restart
+	rootHistoryMutex.Unlock()
+	entries := rootsOf(t, "olga")
+	if len(entries) != 3 || !bytes.Equal(entries[2].hash, second) || entries[1].source != "rootreply" {
+		t.Fatal("history read back as ", entries)
+	}
+	pub := pubkeyToByteSlice(computePubKey(key))
+	if !entries[1].verifiedBy(pub) {
+		t.Fatal("the signed root is not verified by the key of olga")
+	}
+	if entries[0].verifiedBy(pub) || entries[1].verifiedBy(pubkeyToByteSlice(computePubKey(privKeyGen()))) {
+		t.Fatal("a root verified without a signature, or by another key")
+	}
+}
+
+func treeOf(t *testing.T, files map[string]string) Node {
+	dir := t.TempDir()
+	for name, content := range files {
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	tree, err := createTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestDiffRoots(t *testing.T) {
+	cacheDir = t.TempDir()
+	forgetRoots("oscar")
+	defer forgetRoots("oscar")
+	before := treeOf(t, map[string]string{"same": "same", "changed": "before", "removed": "removed"})
+	after := treeOf(t, map[string]string{"same": "same", "changed": "after", "added": "added"})
+	conn := fakePeer(t, func(frame *Frame) marshaler {
+		if frame.Type != MSG_GET_DATUM {
+			return nil
+		}
+		for _, tree := range []Node{before, after} {
+			if n := findNode(frame.Body, tree); n != nil {
+				return &DatumMsg{Id: frame.Id, Hash: n.Hash, Value: datumValue(*n)}
+			}
+		}
+		return &GetDatumMsg{Id: frame.Id, Type: MSG_NO_DATUM, Hash: frame.Body}
+	})
+	peer := sessionOf(conn)
+	sessionsMutex.Lock()
+	peer.name = "oscar"
+	sessionsMutex.Unlock()
+	recordRoot("oscar", before.Hash, nil)
+	recordRoot("oscar", after.Hash, nil)
+
+	old, err := rootFiles("oscar", before.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := rootFiles("oscar", after.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := fileChanges(old, cur); !slices.Equal(changes, []string{"+ /added", "~ /changed", "- /removed"}) {
+		t.Fatal("changes listed as ", changes)
+	}
+	if err := diffRoots("oscar", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := diffRoots("oscar", 0, 2); err == nil {
+		t.Fatal("a root out of the history compared")
+	}
+}
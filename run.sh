@@ -1,2 +1,2 @@
 rm -rf testdump/*
-exec go run main.go cli.go converters.go crypto.go filesystem.go keepalive_thread.go p2p.go p2preqbuilders.go restreqbuilders.go restreqhandlers.go udplistener.go
\ No newline at end of file
+exec go run . "$@"
\ No newline at end of file
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	PEER SESSIONS
+*/
+
+/*
+	A Session holds everything we know about one remote address, be it the REST server or a peer.
+	Sessions are keyed by remote address : they are created by dialPeer when we contact someone,
+	or by the listener when someone contacts us first. The handshake with the server thus never
+	clobbers the handshake with a peer, and we can talk to several peers at once.
+*/
+
+type Session struct {
+	addr          string
+	name          string    // name of the peer on the REST server, empty if unknown
+	conn          *peerConn // non-nil when we dialed this address ourselves
+	helloDone     bool      // hello exchanged, in either direction : we can serve its requests
+	pubkeyDone    bool
+	roothashDone  bool
+	traversalId   uint32 // id of the Hello greeting back the peer we asked a NAT traversal for, 0 if none
+	pubkey        []byte // key published by the peer, every signed message is checked against it
+	hasKey        bool
+	roothash      []byte // root hash published by the peer
+	hasFiles      bool
+	created       time.Time
+	lastSeen      time.Time                  // last datagram received from this address
+	lastHello     time.Time                  // last Hello we sent, see keepalive_thread.go
+	nextId        uint32                     // last id given to one of our requests, see newId
+	pending       map[uint32]*pendingRequest // our requests still waiting for a reply, by id
+	waiting       map[uint32]chan<- Reply    // callers waiting for the reply to one of our requests, by id
+	policy        SignaturePolicy            // how the signatures of this peer are checked
+	signedReplies bool                       // every reply must be signed : the REST server, once its key is pinned
+	badSignature  error                      // why the last rejected message of this peer was rejected
+}
+
+var sessions = make(map[string]*Session)
+var sessionsMutex sync.Mutex
+
+/*
+	Returns the session of a remote address, creating it if we never heard of it.
+	Must be called with sessionsMutex held.
+*/
+
+func lockedSession(addr string) *Session {
+	s, exists := sessions[addr]
+	if !exists {
+		s = &Session{
+			addr:    addr,
+			created: time.Now(),
+			nextId:  rand.Uint32(),
+			pending: make(map[uint32]*pendingRequest),
+			waiting: make(map[uint32]chan<- Reply),
+			policy:  signature_policy,
+		}
+		sessions[addr] = s
+	}
+	return s
+}
+
+func getSession(addr string) *Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return lockedSession(addr)
+}
+
+/*
+	Returns the session of whoever is behind conn.
+*/
+
+func sessionOf(conn net.Conn) *Session {
+	return getSession(conn.RemoteAddr().String())
+}
+
+/*
+	Copy of the session, taken under sessionsMutex : the listener and the keepalive update the
+	session meanwhile, so the CLI reads the fields of this copy instead.
+*/
+
+func (s *Session) snapshot() Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return *s
+}
+
+/*
+	Whether a Hello was exchanged with the session, so that its requests are served.
+*/
+
+func (s *Session) greeted() bool {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return s.helloDone
+}
+
+/*
+	Forgets the handshake, so that the next exchange starts again with a Hello.
+	What the REST server told us about the peer (name, key, root) is kept.
+*/
+
+func (s *Session) reset() {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	s.helloDone = false
+	s.pubkeyDone = false
+	s.roothashDone = false
+	s.traversalId = 0
+	s.pending = make(map[uint32]*pendingRequest)
+}
+
+/*
+	REQUESTS IN FLIGHT
+*/
+
+/*
+	Every request we send gets an id of its own session, never used by another request waiting for
+	its reply : ids start at a random value, so that the replies to a previous run of the client
+	are not taken for replies to this one. A request is pending from the moment it is sent until
+	its reply comes or its sender gives up on it (see abandon) ; a reply whose id is not pending,
+	or whose type does not answer the type of the request, is rejected by handleReply.
+	Requests sent again keep their id : the retries are counted, for the requests command.
+*/
+
+type pendingRequest struct {
+	msgtype byte
+	sent    time.Time // first sending
+	retries int       // times it was sent again
+}
+
+func (s *Session) newId() uint32 {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	for {
+		s.nextId++
+		_, pending := s.pending[s.nextId]
+		_, waited := s.waiting[s.nextId]
+		if s.nextId != 0 && !pending && !waited {
+			return s.nextId
+		}
+	}
+}
+
+func (s *Session) sent(id uint32, msgtype byte) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if p, found := s.pending[id]; found && p.msgtype == msgtype {
+		p.retries++
+	} else {
+		s.pending[id] = &pendingRequest{msgtype: msgtype, sent: time.Now()}
+	}
+	if msgtype == MSG_HELLO {
+		s.lastHello = time.Now()
+	}
+}
+
+/*
+	Tells whether a reply of type reply may answer a request of type request.
+*/
+
+func repliesTo(reply byte, request byte) bool {
+	switch reply {
+	case MSG_ERROR_REPLY:
+		return true
+	case MSG_HELLO_REPLY:
+		return request == MSG_HELLO
+	case MSG_PUBLIC_KEY_REPLY:
+		return request == MSG_PUBLIC_KEY
+	case MSG_ROOT_REPLY:
+		return request == MSG_ROOT
+	case MSG_DATUM, MSG_NO_DATUM:
+		return request == MSG_GET_DATUM
+	}
+	return false
+}
+
+/*
+	Forgets the requests nobody answered for SESSION_EXPIRY, such as keepalives to a peer gone,
+	and the sessions of the addresses we did not dial and did not hear from for SESSION_EXPIRY :
+	anybody can send us datagrams from any address, so they would pile up forever.
+*/
+
+func forgetStaleRequests(now time.Time) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	for addr, s := range sessions {
+		for id, p := range s.pending {
+			if now.Sub(p.sent) > SESSION_EXPIRY {
+				delete(s.pending, id)
+			}
+		}
+		idle := s.created
+		if s.lastSeen.After(idle) {
+			idle = s.lastSeen
+		}
+		if s.conn == nil && len(s.pending) == 0 && len(s.waiting) == 0 && now.Sub(idle) > SESSION_EXPIRY {
+			delete(sessions, addr)
+		}
+	}
+}
+
+/*
+	requests command : lists our requests waiting for a reply, oldest first.
+*/
+
+func printRequests() {
+	type inflight struct {
+		peer string
+		id   uint32
+		pendingRequest
+	}
+	var list []inflight
+	sessionsMutex.Lock()
+	for _, s := range sessions {
+		peer := s.addr
+		if s.name != "" {
+			peer = s.name + " (" + s.addr + ")"
+		}
+		for id, p := range s.pending {
+			list = append(list, inflight{peer, id, *p}) // a copy, read without the lock
+		}
+	}
+	sessionsMutex.Unlock()
+	if len(list) == 0 {
+		fmt.Println("No request waiting for a reply.")
+		return
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].sent.Before(list[j].sent)
+	})
+	for _, r := range list {
+		fmt.Printf("%s %d to %s : sent %s ago, %d retries\n", msgTypeNames[r.msgtype], r.id, r.peer, time.Since(r.sent).Round(time.Millisecond), r.retries)
+	}
+}
+
+/*
+	A reply, as handed by the listener to the caller waiting for it : packet is the header and the
+	body, signature checked and removed.
+*/
+
+type Reply struct {
+	From   *Session
+	Packet []byte
+	Frame  *Frame
+}
+
+/*
+	Makes the listener hand the replies carrying id to ch, until abandon is called.
+	Several ids may share a channel. Must be called before the request is sent, for its reply
+	may come back at once.
+*/
+
+func (s *Session) await(id uint32, ch chan<- Reply) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	s.waiting[id] = ch
+}
+
+/*
+	Stops waiting for the reply to id : if it comes after all, it is rejected.
+*/
+
+func (s *Session) abandon(id uint32) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	delete(s.waiting, id)
+	delete(s.pending, id)
+}
+
+/*
+	Takes the root hash a named peer sends in a Root or RootReply as its new root, and records it.
+	Its signature was already checked by checkSignature.
+*/
+
+func (s *Session) learnRoot(frame *Frame) {
+	sessionsMutex.Lock()
+	name := s.name
+	if name != "" && len(frame.Body) == 32 {
+		s.roothash = append([]byte{}, frame.Body...)
+		s.hasFiles = true
+	}
+	sessionsMutex.Unlock()
+	if name != "" {
+		recordRoot(name, frame.Body, frame)
+	}
+}
+
+/*
+	PEER TABLE
+*/
+
+/*
+	The peers we are connected to : sessions we dialed ourselves and know the name of.
+	The CLI works on one of them at a time (currentPeer), the others stay connected.
+*/
+
+func livePeers() []*Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	var peers []*Session
+	for _, s := range sessions {
+		if s.name != "" && s.conn != nil {
+			peers = append(peers, s)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].name < peers[j].name
+	})
+	return peers
+}
+
+func findPeer(name string) *Session {
+	for _, s := range livePeers() {
+		if s.snapshot().name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+/*
+	Closes the connection to a peer : the keepalive forgets it.
+*/
+
+func disconnectPeer(s *Session) {
+	sessionsMutex.Lock()
+	conn := s.conn
+	sessionsMutex.Unlock()
+	if conn != nil {
+		conn.Close() // takes sessionsMutex
+	}
+	s.reset()
+	if currentPeer == s {
+		currentPeer = nil
+	}
+}
+
+func printPeers() {
+	peers := livePeers()
+	if len(peers) == 0 {
+		fmt.Println("Not connected to any peer.")
+		return
+	}
+	for _, peer := range peers {
+		marker := " "
+		if peer == currentPeer {
+			marker = "*"
+		}
+		s := peer.snapshot()
+		lastseen := "never"
+		if !s.lastSeen.IsZero() {
+			lastseen = time.Since(s.lastSeen).Round(time.Second).String() + " ago"
+		}
+		files := "no files"
+		if s.hasFiles {
+			files = "sharing files"
+		}
+		fmt.Printf("%s %s (%s) : last seen %s, %s, signatures %s\n", marker, s.name, s.addr, lastseen, files, s.policy)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+	SIGNATURE POLICY
+*/
+
+/*
+	Hello, PublicKey and Root, and their replies, must be signed by peers that published a key ;
+	other messages may be signed. Every datagram goes through checkSignature, with the policy of
+	the session it comes from :
+	- off : signatures are never checked ;
+	- opportunistic : a peer that published a key must sign the mandatory messages with it, and
+	  any signature it adds to other messages must be valid ; peers without a key are trusted ;
+	- strict : same, but the mandatory messages of a peer without a published key are refused,
+	  so that we only ever talk to peers we can authenticate.
+	The key of a peer is fetched from the REST server when we connect to it, or upon its first
+	Hello when it contacts us first (see identify).
+	New sessions get the signatures setting of the configuration, the signatures command changes it.
+	The REST server is checked more strictly once its key is pinned (see pinServerKey) : all its
+	replies must be signed, whatever the policy.
+*/
+
+type SignaturePolicy int
+
+const (
+	SIG_OFF SignaturePolicy = iota
+	SIG_OPPORTUNISTIC
+	SIG_STRICT
+)
+
+var signature_policy = SIG_OPPORTUNISTIC // policy of new sessions
+
+func (p SignaturePolicy) String() string {
+	switch p {
+	case SIG_OFF:
+		return "off"
+	case SIG_STRICT:
+		return "strict"
+	}
+	return "opportunistic"
+}
+
+func parseSignaturePolicy(s string) (SignaturePolicy, error) {
+	switch strings.ToLower(s) {
+	case "off":
+		return SIG_OFF, nil
+	case "opportunistic":
+		return SIG_OPPORTUNISTIC, nil
+	case "strict":
+		return SIG_STRICT, nil
+	}
+	return SIG_OPPORTUNISTIC, fmt.Errorf("unknown signature policy %q, expected off, opportunistic or strict", s)
+}
+
+func mustBeSigned(msgtype byte) bool {
+	switch msgtype {
+	case MSG_HELLO, MSG_HELLO_REPLY, MSG_PUBLIC_KEY, MSG_PUBLIC_KEY_REPLY, MSG_ROOT, MSG_ROOT_REPLY:
+		return true
+	}
+	return false
+}
+
+/*
+	Checks the signature of a message from peer against the key it published, following its policy.
+	Returns an error wrapping ErrBadSignature when the message must be ignored, which is also
+	remembered in the session so that the handshake can tell why it got no reply.
+*/
+
+func checkSignature(peer *Session, frame *Frame) error {
+	err := signatureError(peer, frame)
+	if err != nil {
+		sessionsMutex.Lock()
+		peer.badSignature = err
+		sessionsMutex.Unlock()
+	}
+	return err
+}
+
+func signatureError(peer *Session, frame *Frame) error {
+	sessionsMutex.Lock()
+	policy := peer.policy
+	key := peer.pubkey
+	if !peer.hasKey {
+		key = nil
+	}
+	mandatory := mustBeSigned(frame.Type) || (peer.signedReplies && frame.Type >= 128)
+	if peer.signedReplies {
+		policy = SIG_STRICT
+	}
+	sessionsMutex.Unlock()
+	if policy == SIG_OFF {
+		return nil
+	}
+	msgname := msgTypeNames[frame.Type]
+	if msgname == "" {
+		msgname = fmt.Sprintf("type %d", frame.Type)
+	}
+	if len(key) != 64 {
+		if policy == SIG_STRICT && mandatory {
+			return fmt.Errorf("%w : %s from %s, which has no published key", ErrBadSignature, msgname, peer.addr)
+		}
+		return nil
+	}
+	if len(frame.Signature) == 0 {
+		if mandatory {
+			return fmt.Errorf("%w : unsigned %s from %s", ErrBadSignature, msgname, peer.addr)
+		}
+		return nil
+	}
+	if !verify(frame.Signed(), frame.Signature, byteSliceToPubkey(key)) {
+		return fmt.Errorf("%w : %s from %s is not signed by its published key", ErrBadSignature, msgname, peer.addr)
+	}
+	return nil
+}
+
+/*
+	signatures command : signatures alone shows the policies, signatures <policy> sets the policy
+	of every session and of the new ones, signatures <policy> <name> the policy of one peer.
+*/
+
+func signaturesCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Default : " + signature_policy.String())
+		for _, peer := range livePeers() {
+			s := peer.snapshot()
+			fmt.Println(s.name + " : " + s.policy.String())
+		}
+		return
+	}
+	policy, err := parseSignaturePolicy(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(args) > 1 {
+		peer := findPeer(args[1])
+		if peer == nil {
+			fmt.Println("Not connected to " + args[1] + ".")
+			return
+		}
+		sessionsMutex.Lock()
+		peer.policy = policy
+		sessionsMutex.Unlock()
+		return
+	}
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	signature_policy = policy
+	for _, s := range sessions {
+		s.policy = policy
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+	Says hello to our listener from a new socket, signed with key if not nil, and returns the
+	reply, or nil if none came.
+*/
+
+func helloUs(t *testing.T, name string, key *ecdsa.PrivateKey) (*Frame, string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packet, _ := (&HelloMsg{Id: 1, Type: MSG_HELLO, Name: name}).Marshal()
+	if key != nil {
+		packet = signByteSlice(packet, key)
+	}
+	conn.WriteTo(packet, listener.LocalAddr())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, MAX_MESSAGE_SIZE)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, conn.LocalAddr().String()
+	}
+	frame := &Frame{}
+	if err := frame.Unmarshal(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return frame, conn.LocalAddr().String()
+}
+
+var daveKey = privKeyGen() // the server keeps dave registered with it between runs
+
+func TestInboundHelloIsChecked(t *testing.T) {
+	defer setKnownPeer("dave", nil)
+	key := daveKey
+	dave := dialTestPeer(t, testServer, key)
+	dave.hello(t, "dave", 1)
+	dave.await(t, MSG_HELLO_REPLY)
+	dave.send(t, &RootMsg{Id: 2, Type: MSG_ROOT, Hash: emptyStringHash})
+	dave.await(t, MSG_ROOT_REPLY) // the server has his key
+
+	rep, addr := helloUs(t, "dave", key)
+	if rep == nil || rep.Type != MSG_HELLO_REPLY {
+		t.Fatal("no HelloReply to dave : ", rep)
+	}
+	s := getSession(addr)
+	sessionsMutex.Lock()
+	name, pubkey := s.name, s.pubkey
+	sessionsMutex.Unlock()
+	if name != "dave" || !bytes.Equal(pubkey, pubkeyToByteSlice(computePubKey(key))) {
+		t.Fatal("the session of dave did not get his key")
+	}
+	if rep, _ := helloUs(t, "dave", nil); rep != nil {
+		t.Fatal("unsigned Hello from dave answered with ", msgTypeNames[rep.Type])
+	}
+	if rep, _ := helloUs(t, "dave", privKeyGen()); rep != nil {
+		t.Fatal("Hello from dave signed by another key answered with ", msgTypeNames[rep.Type])
+	}
+	if rep, _ := helloUs(t, "erin", nil); rep == nil || rep.Type != MSG_HELLO_REPLY {
+		t.Fatal("no HelloReply to a peer without a key : ", rep)
+	}
+}
+
+func TestKeyLookupsAreBounded(t *testing.T) {
+	lookupsMutex.Lock()
+	inflight := lookups // of the Hellos the listener still identifies
+	lookups = make(map[string]time.Time)
+	lookupsMutex.Unlock()
+	defer func() {
+		lookupsMutex.Lock()
+		lookups = inflight
+		lookupsMutex.Unlock()
+	}()
+	now := time.Now()
+	if err := startLookup("heidi", now); err != nil {
+		t.Fatal(err)
+	}
+	if startLookup("heidi", now) == nil {
+		t.Fatal("two lookups of heidi at once")
+	}
+	endLookup("heidi", ErrServer)
+	if startLookup("heidi", now.Add(LOOKUP_BACKOFF/2)) == nil {
+		t.Fatal("heidi looked up again right after a failure")
+	}
+	if err := startLookup("heidi", now.Add(2*LOOKUP_BACKOFF)); err != nil {
+		t.Fatal("heidi never looked up again : ", err)
+	}
+	endLookup("heidi", nil)
+	for i := 0; i < MAX_LOOKUPS; i++ {
+		if err := startLookup(fmt.Sprint("sybil", i), now); err != nil {
+			t.Fatal(err)
+		}
+		defer endLookup(fmt.Sprint("sybil", i), nil)
+	}
+	if startLookup("ivan", now) == nil {
+		t.Fatal("more than MAX_LOOKUPS lookups at once")
+	}
+}
+
+/*
+	A server answering with another key than the one pinned in the configuration.
+*/
+
+func TestImpersonatedServer(t *testing.T) {
+	impostor, err := startRendezvous("127.0.0.1:0", "127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impostor.Close()
+	defer func(key []byte, timeout, deadline time.Duration) {
+		serv_key, reply_timeout, request_deadline = key, timeout, deadline
+	}(serv_key, reply_timeout, request_deadline)
+	serv_key = testServer.PublicKey()
+	reply_timeout = 50 * time.Millisecond
+	request_deadline = 300 * time.Millisecond
+	conn, err := dialPeer(impostor.UDPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setServerConn(conn)
+	defer func() {
+		disconnectPeer(sessionOf(conn))
+		setServerConn(nil)
+	}()
+	if err := pinServerKey(sessionOf(conn)); err != nil {
+		t.Fatal(err)
+	}
+	err = registerPeer(activeIdentity())
+	if !errors.Is(err, ErrBadSignature) || !strings.Contains(err.Error(), "may be impersonated") {
+		t.Fatal("registered with an impostor : ", err)
+	}
+}
@@ -1,10 +1,445 @@
 package main
 
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
 /*
 	Passive UDP listener
 */
 
+/*
+	Every UDP exchange of our node goes through a single bound socket (listener), so that the
+	address announced to the REST server is also the one peers reach when they contact us first.
+	UDPListener is the only reader of this socket : it decodes every datagram, checks it against
+	the signature policy of its sender, and dispatches it by type :
+	- requests are answered directly, from the shared tree, whoever sent them : nobody has to be
+	  reading for the server or a peer to get an answer ;
+	- replies update the session of their sender (handshake, root hash), then are handed by id
+	  to the caller waiting for them (see await), if any, on its own channel.
+	The rest of the client never reads : it sends a request and waits on a channel, so that a
+	reply can no longer be consumed by a caller it was not meant for.
+*/
+
+/*
+	peerConn is a net.Conn bound to one remote address on top of the shared listener socket.
+	It is write-only : what comes from this address is dispatched by the listener.
+*/
+
+type peerConn struct {
+	raddr  *net.UDPAddr
+	closed chan struct{}
+}
+
+func dialPeer(address string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	c := &peerConn{
+		raddr:  raddr,
+		closed: make(chan struct{}),
+	}
+	s := getSession(raddr.String())
+	s.reset() // a new exchange starts with a new handshake
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if s.conn != nil {
+		close(s.conn.closed)
+	}
+	s.conn = c
+	return c, nil
+}
+
+func (c *peerConn) Read(b []byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Net: "udp", Addr: c.raddr, Err: errors.ErrUnsupported} // replies are routed by the listener
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	faults.opened(c.raddr.String())
+	faults.inject(FAULT_SEND, b, func(packet []byte) {
+		listener.WriteToUDP(packet, c.raddr)
+	})
+	return len(b), nil
+}
+
+func (c *peerConn) Close() error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	select {
+	case <-c.closed:
+		return nil
+	default:
+		close(c.closed)
+	}
+	s, exists := sessions[c.raddr.String()]
+	if exists && s.conn == c {
+		s.conn = nil
+	}
+	return nil
+}
+
+func (c *peerConn) LocalAddr() net.Addr {
+	return listener.LocalAddr()
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *peerConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *peerConn) SetReadDeadline(t time.Time) error {
+	return nil // nothing reads a peerConn, callers wait with a timeout of their own
+}
+
+func (c *peerConn) SetWriteDeadline(t time.Time) error {
+	return nil // writes on UDP never block
+}
+
+/*
+	Listening loop, started once at launch and running alongside the CLI.
+*/
+
+func startListener(address string) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		log.Fatal("Unable to resolve the listening address : ", err)
+	}
+	listener, err = net.ListenUDP("udp", laddr)
+	if err != nil {
+		log.Fatal("Unable to bind the listening socket : ", err)
+	}
+	logProgress("Listening on " + listener.LocalAddr().String())
+	go UDPListener()
+}
+
 func UDPListener() {
-	// TODO
-	// upon reception of a GetDatum, reply to the peer with arborescence
+	for {
+		buf := make([]byte, MAX_MESSAGE_SIZE)
+		n, addr, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logProgress("Error reading from the listening socket : " + err.Error())
+			continue
+		}
+		if faults.filtered(addr.String()) {
+			logProgress("Simulated NAT : dropping a datagram from " + addr.String())
+			continue
+		}
+		faults.inject(FAULT_RECEIVE, buf[:n], func(packet []byte) {
+			deliver(addr, packet)
+		})
+	}
+}
+
+/*
+	Decodes a datagram and dispatches it : replies to handleReply, requests to answerRequest.
+	A malformed datagram is dropped, with an error sent back when its header tells us who to
+	answer. Nothing is trusted from the datagram, so that a malformed or truncated packet can
+	never crash us. Datagrams that fail the signature policy of their sender (see checkSignature)
+	are dropped without an answer. The Hello of a peer we know nothing about waits for its key
+	(see identify).
+*/
+
+func deliver(addr *net.UDPAddr, packet []byte) {
+	conn := &peerConn{raddr: addr} // write-only, never registered
+	frame := &Frame{}
+	if err := frame.Unmarshal(packet); err != nil {
+		logProgress("Dropping invalid datagram from " + addr.String() + " : " + err.Error())
+		if len(packet) >= HEADER_SIZE && packet[4] != MSG_ERROR && packet[4] != MSG_ERROR_REPLY { // never answer an error with an error
+			communicateError(conn, "Invalid datagram : "+err.Error(), packet[4], binary.BigEndian.Uint32(packet[0:4]))
+		}
+		return
+	}
+	s := getSession(addr.String()) // only once the datagram is one of ours, see forgetStaleRequests
+	hello := &HelloMsg{}
+	if frame.Type == MSG_HELLO && hello.Unmarshal(packet) == nil && unidentified(s) {
+		if err := startLookup(hello.Name, time.Now()); err != nil {
+			logProgress("Dropping Hello from " + s.addr + " : " + err.Error())
+			return
+		}
+		go func() { // the REST server may be slow : keep on receiving meanwhile
+			err := identify(s, hello)
+			endLookup(hello.Name, err)
+			if err != nil {
+				logProgress("Dropping Hello from " + s.addr + " : " + err.Error())
+				return
+			}
+			dispatch(s, conn, packet, frame)
+		}()
+		return
+	}
+	dispatch(s, conn, packet, frame)
+}
+
+/*
+	Checks a decoded datagram against the signature policy of its sender, then hands it to
+	handleReply or answerRequest.
+*/
+
+func dispatch(s *Session, conn net.Conn, packet []byte, frame *Frame) {
+	if err := checkSignature(s, frame); err != nil {
+		logProgress("Dropping datagram : " + err.Error())
+		return
+	}
+	sessionsMutex.Lock()
+	s.lastSeen = time.Now() // only the genuine datagrams of a peer keep its session alive
+	sessionsMutex.Unlock()
+	packet = packet[:HEADER_SIZE+len(frame.Body)]
+	if repdisplay {
+		fmt.Println("*** Recus:")
+		fmt.Println("Id: ", packet[0:4])
+		fmt.Println("type: ", packet[4])
+		fmt.Println("length: ", packet[5:7])
+		if len(frame.Body) > 0 {
+			fmt.Println("body:", frame.Body)
+		} else {
+			fmt.Println("body empty")
+		}
+	}
+	displayError(packet)
+	if frame.Type >= 128 {
+		handleReply(s, packet, frame)
+		return
+	}
+	answerRequest(s, conn, packet, frame)
+}
+
+/*
+	A peer contacting us first is only known by its address, until its Hello gives us its name :
+	the REST server then gives us its key, which is checked against its pin (see peerKey)
+	and kept in its session, so that the signature policy applies to it as to the peers we dial.
+	A name the REST server does not know, and that we never pinned, has no key. While its key
+	can neither be fetched nor found pinned, its Hello is dropped : the peer will say hello again.
+	So is the Hello of a name we could not pin (see checkPeerName).
+	Anybody can say hello under any name, and each Hello would cost us a request to the REST
+	server : at most MAX_LOOKUPS keys are fetched at once, one per name, and a name whose key
+	could not be fetched is not looked up again for LOOKUP_BACKOFF. Its Hellos are dropped
+	meanwhile.
+*/
+
+var MAX_LOOKUPS = 16
+var LOOKUP_BACKOFF = 30 * time.Second
+
+var lookups = make(map[string]time.Time) // names being looked up (zero time), or when their lookup failed
+var lookupsMutex sync.Mutex
+
+func startLookup(name string, now time.Time) error {
+	if err := checkPeerName(name); err != nil {
+		return err
+	}
+	lookupsMutex.Lock()
+	defer lookupsMutex.Unlock()
+	inflight := 0
+	for n, failed := range lookups {
+		if failed.IsZero() {
+			inflight++
+		} else if now.Sub(failed) > LOOKUP_BACKOFF {
+			delete(lookups, n)
+		}
+	}
+	failed, found := lookups[name]
+	switch {
+	case found && failed.IsZero():
+		return fmt.Errorf("the key of %s is being fetched already", name)
+	case found:
+		return fmt.Errorf("the key of %s could not be fetched %s ago", name, now.Sub(failed).Round(time.Second))
+	case inflight >= MAX_LOOKUPS:
+		return fmt.Errorf("%d keys are being fetched already", inflight)
+	}
+	lookups[name] = time.Time{}
+	return nil
+}
+
+func endLookup(name string, err error) {
+	lookupsMutex.Lock()
+	defer lookupsMutex.Unlock()
+	if err != nil {
+		lookups[name] = time.Now()
+	} else {
+		delete(lookups, name)
+	}
+}
+
+func unidentified(s *Session) bool {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return s.name == "" && s.policy != SIG_OFF && !s.signedReplies
+}
+
+func identify(s *Session, hello *HelloMsg) error {
+	if err := checkPeerName(hello.Name); err != nil {
+		return err
+	}
+	key, err := peerKey(hello.Name)
+	if errors.Is(err, ErrNotFound) {
+		key, err = nil, nil // neither registered nor pinned
+	}
+	if err != nil {
+		return err
+	}
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if s.name == "" {
+		s.name = hello.Name
+		s.pubkey = key
+		s.hasKey = len(key) == 64
+		logProgress("Peer " + s.addr + " is " + hello.Name)
+	}
+	return nil
+}
+
+/*
+	Checks that a reply answers one of our pending requests, takes note of what it tells us about
+	its session, then hands it to the caller waiting for its id. Replies to requests nobody waits
+	for (a keepalive) stop here.
+*/
+
+func handleReply(s *Session, packet []byte, frame *Frame) {
+	sessionsMutex.Lock()
+	request, found := s.pending[frame.Id]
+	if !found || !repliesTo(frame.Type, request.msgtype) {
+		sessionsMutex.Unlock()
+		logProgress(fmt.Sprintf("%s %d from %s answers no request of ours : rejecting it.", msgTypeNames[frame.Type], frame.Id, s.addr))
+		return
+	}
+	switch frame.Type {
+	case MSG_HELLO_REPLY:
+		s.helloDone = true
+		s.traversalId = 0
+	case MSG_PUBLIC_KEY_REPLY:
+		s.pubkeyDone = true
+	case MSG_ROOT_REPLY:
+		s.roothashDone = true
+	}
+	delete(s.pending, frame.Id)
+	waiter, waited := s.waiting[frame.Id]
+	sessionsMutex.Unlock()
+	if frame.Type == MSG_ROOT_REPLY {
+		s.learnRoot(frame)
+	}
+	if !waited {
+		logProgress(fmt.Sprintf("Nobody waits for reply %d from %s : skipping.", frame.Id, s.addr))
+		return
+	}
+	select {
+	case waiter <- Reply{s, packet, frame}:
+	default:
+		logProgress("Caller too slow for " + s.addr + " : dropping reply.") // it will ask again
+	}
+}
+
+/*
+	Answers a request, from anybody.
+*/
+
+func answerRequest(s *Session, conn net.Conn, packet []byte, frame *Frame) {
+	msgid := frame.Id
+	msgtype := frame.Type
+	switch msgtype {
+	case 0:
+		// NoOp
+		return
+	case 1:
+		// Error
+		return
+	case 2:
+		// Hello
+		hello := &HelloMsg{}
+		if err := hello.Unmarshal(packet); err != nil {
+			communicateError(conn, err.Error(), msgtype, msgid)
+			return
+		}
+		sessionsMutex.Lock()
+		s.helloDone = true
+		greeting := s.traversalId
+		sessionsMutex.Unlock()
+		signAndWrite(conn, helloToByteSlice(buildHelloReply(activeIdentity().Name, msgid)))
+		if greeting != 0 {
+			// the peer we asked a NAT traversal for reached us : greet it back, salute waits for the reply
+			signAndWrite(conn, helloToByteSlice(buildHelloRequest(activeIdentity().Name, greeting, 0)))
+		}
+	case 3:
+		// PublicKey
+		rep := buildPubkeyReplyNoPubkey(msgid)
+		if id := activeIdentity(); id.Key != nil {
+			rep = buildPubkeyReplyWithPubkey(id.PublicKey(), msgid)
+		}
+		signAndWrite(conn, requestToByteSlice(rep))
+	case 4:
+		// Root
+		s.learnRoot(frame)
+		rep := buildRootReply(emptyStringHash, msgid)
+		if tree := sharing(); tree.hasFiles {
+			rep = buildRootReply(tree.hash, msgid)
+		}
+		signAndWrite(conn, requestToByteSlice(rep))
+	case 5:
+		// GetDatum
+		if !s.greeted() {
+			communicateError(conn, "Please say hello first", msgtype, msgid)
+			return
+		}
+		getdatum := &GetDatumMsg{}
+		if err := getdatum.Unmarshal(packet); err != nil {
+			communicateError(conn, err.Error(), msgtype, msgid)
+			return
+		}
+		answerGetDatum(conn, msgid, getdatum.Hash)
+	case 6:
+		// NAT Traversal Request
+		communicateError(conn, "I am not the REST server", msgtype, msgid)
+	case 7:
+		// NAT Traversal : a peer behind us cannot reach us, write to it first to open our NAT
+		if relay := serverConn(); relay == nil || sessionOf(relay) != s {
+			communicateError(conn, "Only the REST server relays NAT traversals", msgtype, msgid) // we would punch for anybody
+			return
+		}
+		traversal := &NatTraversalMsg{}
+		if err := traversal.Unmarshal(packet); err != nil {
+			communicateError(conn, err.Error(), msgtype, msgid)
+			return
+		}
+		logProgress("NAT traversal requested by " + traversal.Addr.String() + " : greeting it.")
+		// the peer answers to our listener, which serves it like any peer contacting us first
+		punch := &peerConn{raddr: net.UDPAddrFromAddrPort(traversal.Addr)}
+		signAndWrite(punch, helloToByteSlice(buildHelloRequest(activeIdentity().Name, sessionOf(punch).newId(), 0)))
+	default:
+		communicateError(conn, fmt.Sprintf("Unknown message type for type %d", msgtype), msgtype, msgid)
+	}
+}
+
+/*
+	Replies to a GetDatum with the matching node of our tree, or a NoDatum if we do not have it.
+*/
+
+func answerGetDatum(conn net.Conn, msgid uint32, hash []byte) {
+	bufid := make([]byte, 4)
+	binary.BigEndian.PutUint32(bufid, msgid)
+	n := findNode(hash, sharing().root)
+	if n == nil {
+		logProgress("No datum for requested hash : replying NoDatum")
+		conn.Write(requestToByteSlice(buildNoDatumReply(hash, msgid)))
+		return
+	}
+	value := datumValue(*n)
+	if !verifyDatum(n.Hash, value) {
+		// never serve a datum a peer would reject, this is a bug in our tree
+		fmt.Println("Error : our node does not match its hash " + hex.EncodeToString(hash))
+		conn.Write(requestToByteSlice(buildNoDatumReply(hash, msgid)))
+		return
+	}
+	conn.Write(datumToByteSlice(buildDatumReply(bufid, value, n.Hash)))
 }